@@ -0,0 +1,457 @@
+// Package app implements the client end of servicemgr for the
+// applications.
+//
+// A Client dials the client port of the server, then authenticates,
+// registers and subscribes per its Config. When the link drops it
+// reconnects, resuming its session if the server still keeps it. The
+// frames from the device are passed to the callbacks of the Config, and
+// every request takes a context:
+//
+//	c, err := app.Dial(ctx, "localhost:22223", app.Config{
+//		MicData: func(pcm []byte) { ... },
+//	})
+//	...
+//	if err = c.OpenMic(ctx); err == app.ErrConnectionGone {
+//		// the device is away
+//	}
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+	DefaultMinBackoff       = 100 * time.Millisecond
+	DefaultMaxBackoff       = 5 * time.Second
+)
+
+var (
+	// ErrClosed is returned after the client is closed.
+	ErrClosed = errors.New("client is closed")
+
+	linkDownErr = errors.New("link is down")
+)
+
+// Credential is the identity to authenticate as, either with the token or
+// the secret of it (see server.Auth).
+type Credential struct {
+	Name   string
+	Token  string
+	Secret string
+}
+
+// Config configures a Client, zero fields take the defaults.
+type Config struct {
+	// TLS is the config to dial the server with TLS, plain if nil.
+	TLS *tls.Config
+	// Auth is the identity if the server requires authentication.
+	Auth *Credential
+	// Register is the registration of the client, none if nil.
+	Register *server.Registration
+	// Subscribe is the types of the unaddressed frames from the device to
+	// receive, e.g. server.TypeScanCode, exclusively if Exclusive.
+	Subscribe []server.Type
+	Exclusive bool
+	// HandshakeTimeout is how long the handshakes take at most.
+	HandshakeTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the delay between the reconnections,
+	// which is doubled after each failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// NoReconnect closes the client when the link drops.
+	NoReconnect bool
+
+	// The callbacks are called one at a time from the goroutine reading
+	// the link, so they shouldn't block.
+
+	// ScanCode is called with the scan codes from the device.
+	ScanCode func(v []byte)
+	// MicData is called with the pcm of the mic opened.
+	MicData func(pcm []byte)
+	// Frame is called with the other frames, e.g. server.TypeMessage.
+	Frame func(t server.Type, v []byte)
+	// Error is called with the error frames no request waits for, e.g.
+	// ErrConnectionGone when the device drops.
+	Error func(err error)
+
+	// Logger is the default logger if nil.
+	Logger *slog.Logger
+}
+
+func (c *Config) setDefaults() {
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DefaultMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = DefaultMaxBackoff
+		if c.MaxBackoff < c.MinBackoff {
+			c.MaxBackoff = c.MinBackoff
+		}
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+}
+
+// Client is the client end of a link, which reconnects when it drops.
+type Client struct {
+	config Config
+	addr   string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// nil while reconnecting, up is closed once it's set
+	conn net.Conn
+	up   chan struct{}
+	id   uint32
+	// the resume token of the session
+	token string
+	// whether the mic should be open
+	mic     bool
+	waiters []*waiter
+	pingSeq uint64
+
+	wmu sync.Mutex
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// Dial connects to the client port of the server at addr.
+func Dial(ctx context.Context, addr string, config Config) (*Client, error) {
+	config.setDefaults()
+	c := &Client{
+		config: config,
+		addr:   addr,
+		up:     make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+	c.setConn(conn)
+	go c.run(conn)
+	return c, nil
+}
+
+// Id returns the client id, which may change after reconnecting if the
+// session isn't resumed.
+func (c *Client) Id() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// Done is closed when the client is closed, see Err.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the client is closed.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the client.
+func (c *Client) Close() error {
+	c.shutdown(ErrClosed)
+	return nil
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.cancel()
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+}
+
+// setConn sets the link up, or down if conn is nil.
+func (c *Client) setConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn != nil {
+		c.conn = conn
+		close(c.up)
+		return
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.up = make(chan struct{})
+	}
+	// the replies are gone with the link
+	for _, w := range c.waiters {
+		w.ch <- result{err: linkDownErr}
+	}
+	c.waiters = nil
+}
+
+// run polls the link and reconnects when it drops, until the client is
+// closed.
+func (c *Client) run(conn net.Conn) {
+	for {
+		err := c.poll(conn)
+		c.setConn(nil)
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if c.config.NoReconnect {
+			c.shutdown(err)
+			return
+		}
+		c.config.Logger.Warn("link dropped, reconnect", "err", err)
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+		c.setConn(conn)
+		c.config.Logger.Info("reconnected", "id", c.Id())
+	}
+}
+
+// reconnect connects again with backoff, it returns nil if the client is
+// closed meanwhile.
+func (c *Client) reconnect() net.Conn {
+	backoff := c.config.MinBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return nil
+		}
+
+		conn, err := c.connect(c.ctx)
+		if err == nil {
+			return conn
+		}
+		if err == ErrPermissionDenied {
+			c.shutdown(err)
+			return nil
+		}
+		c.config.Logger.Warn("reconnect failed", "err", err, "retry", backoff)
+		if backoff *= 2; backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// poll reads the frames until the link drops.
+func (c *Client) poll(conn net.Conn) error {
+	for {
+		tlv, err := util.ReadTLV(conn)
+		if err != nil {
+			return err
+		}
+		c.handle(conn, tlv)
+	}
+}
+
+// connect dials the server and runs the handshakes.
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.TLS != nil {
+		tc := tls.Client(conn, c.config.TLS)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	conn.SetDeadline(time.Now().Add(c.config.HandshakeTimeout))
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	err = c.handshake(conn)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type authRequest struct {
+	Name     string `json:"name"`
+	Token    string `json:"token,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+type resumeMessage struct {
+	Id    uint32 `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// handshake authenticates, then resumes the session, or starts a new one
+// if there isn't.
+func (c *Client) handshake(conn net.Conn) error {
+	if a := c.config.Auth; a != nil {
+		v, err := c.exchange(conn, server.TypeAuth, authRequest{Name: a.Name, Token: a.Token})
+		if err != nil {
+			return err
+		}
+		if a.Token == "" {
+			var challenge struct {
+				Challenge string `json:"challenge"`
+			}
+			if err = json.Unmarshal(v, &challenge); err != nil {
+				return err
+			}
+			b, err := hex.DecodeString(challenge.Challenge)
+			if err != nil {
+				return err
+			}
+			response := hex.EncodeToString(server.ChallengeResponse(a.Secret, b))
+			if _, err = c.exchange(conn, server.TypeAuth, authRequest{Name: a.Name, Response: response}); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.mu.Lock()
+	token, mic := c.token, c.mic
+	c.mu.Unlock()
+	if token != "" {
+		var resumed resumeMessage
+		v, err := c.exchange(conn, server.TypeResume, resumeMessage{Token: token})
+		if err == nil {
+			err = json.Unmarshal(v, &resumed)
+		}
+		if err == nil {
+			c.setSession(resumed)
+			return nil
+		}
+		if err != ErrSessionExpired {
+			return err
+		}
+		c.config.Logger.Info("session expired, start a new one")
+	}
+
+	var id uint32
+	if r := c.config.Register; r != nil {
+		v, err := c.exchange(conn, server.TypeRegister, r)
+		if err != nil {
+			return err
+		}
+		var registered struct {
+			Id uint32 `json:"id"`
+		}
+		if err = json.Unmarshal(v, &registered); err != nil {
+			return err
+		}
+		id = registered.Id
+	}
+	if len(c.config.Subscribe) != 0 {
+		types := make([]string, len(c.config.Subscribe))
+		for i, t := range c.config.Subscribe {
+			types[i] = t.String()
+		}
+		req := struct {
+			Types     []string `json:"types"`
+			Exclusive bool     `json:"exclusive,omitempty"`
+		}{types, c.config.Exclusive}
+		if _, err := c.exchange(conn, server.TypeSubscribe, req); err != nil {
+			return err
+		}
+	}
+	var sess resumeMessage
+	if !c.config.NoReconnect {
+		v, err := c.exchange(conn, server.TypeResume, nil)
+		if err == nil {
+			err = json.Unmarshal(v, &sess)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if sess.Id == 0 {
+		sess.Id = id
+	}
+	c.setSession(sess)
+
+	if mic {
+		// the new session doesn't have the mic opened before
+		return util.WriteTLV(conn, util.TLV{T: uint64(server.TypeOpenMic)})
+	}
+	return nil
+}
+
+func (c *Client) setSession(sess resumeMessage) {
+	c.mu.Lock()
+	c.id, c.token = sess.Id, sess.Token
+	c.mu.Unlock()
+}
+
+// exchange sends a frame of type t with req in json, or empty if nil, and
+// returns the value of the reply of the same type, or the error of an
+// error frame. The other frames in between, e.g. the pings and the frames
+// from the device, are handled as usual.
+func (c *Client) exchange(conn net.Conn, t server.Type, req interface{}) ([]byte, error) {
+	tlv := util.TLV{T: uint64(t)}
+	if req != nil {
+		v, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		tlv.L, tlv.V = uint64(len(v)), v
+	}
+	if err := util.WriteTLV(conn, tlv); err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := util.ReadTLV(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch rt := server.Type(reply.T); {
+		case rt == t:
+			return reply.V, nil
+		case isError(rt):
+			return nil, Error(rt)
+		default:
+			c.handle(conn, reply)
+		}
+	}
+}
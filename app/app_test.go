@@ -0,0 +1,280 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/device"
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/server/servertest"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// startServer serves a server with config and a device on it, and returns
+// them with the client address.
+func startServer(t *testing.T, config server.Config) (*server.Server, *device.Device, string) {
+	t.Helper()
+	config.ShutdownTimeout = 10 * time.Millisecond
+	srv, deviceAddr, clientAddr := servertest.Start(t, config)
+	d, err := device.Dial(context.Background(), deviceAddr, device.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	servertest.WaitState(t, srv, server.StateReady)
+	return srv, d, clientAddr
+}
+
+// recv returns the next frame of the session s of type typ.
+func recv(t *testing.T, s *device.Session, typ server.Type) device.Frame {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for {
+		f, err := s.Recv(ctx)
+		if err != nil {
+			t.Fatalf("wait %v: %s", typ, err)
+		}
+		if f.Type == typ {
+			return f
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	auth, err := server.ParseAuth([]byte(`{"identities": {"ui": {"secret": "yyy", "allow": ["*"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, d, addr := startServer(t, server.Config{Auth: auth})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err = Dial(ctx, addr, Config{Auth: &Credential{Name: "ui", Secret: "bad"}}); err != ErrPermissionDenied {
+		t.Errorf("expect %v, but got %v", ErrPermissionDenied, err)
+	}
+
+	scanCodes := make(chan []byte, 1)
+	mic := make(chan []byte, 16)
+	errs := make(chan error, 1)
+	c, err := Dial(ctx, addr, Config{
+		Auth:      &Credential{Name: "ui", Secret: "yyy"},
+		Register:  &server.Registration{Name: "recorder"},
+		Subscribe: []server.Type{server.TypeScanCode},
+		ScanCode:  func(v []byte) { scanCodes <- v },
+		MicData:   func(pcm []byte) { mic <- pcm },
+		Error:     func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Id() == 0 {
+		t.Error("expect an id assigned")
+	}
+
+	// the device echoes it
+	if _, err = c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	d.SendScanCode(0, []byte("42"))
+	select {
+	case v := <-scanCodes:
+		if string(v) != "42" {
+			t.Errorf("expect the scan code 42, but got %q", v)
+		}
+	case <-ctx.Done():
+		t.Fatal("wait the scan code timeout")
+	}
+
+	opened := make(chan error)
+	go func() { opened <- c.OpenMic(ctx) }()
+	s, err := d.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv(t, s, server.TypeOpenMic)
+	s.StreamMic(ctx, bytes.NewReader([]byte{1, 2, 3, 4}), 0)
+	if err = <-opened; err != nil {
+		t.Fatal(err)
+	}
+	if pcm := <-mic; !bytes.Equal(pcm, []byte{1, 2, 3, 4}) {
+		t.Errorf("unexpected mic %v", pcm)
+	}
+	if err = c.CloseMic(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recv(t, s, server.TypeCloseMic)
+
+	if err = c.SendFile(ctx, "a.txt", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if file := device.ParseFileTransfer(recv(t, s, server.TypeFileTransfer).Value); file.Name != "a.txt" || string(file.Data) != "hello" {
+		t.Errorf("unexpected file %+v", file)
+	}
+
+	if err = c.PlaySound(ctx, bytes.NewReader(make([]byte, 5000))); err != nil {
+		t.Fatal(err)
+	}
+	recv(t, s, server.TypeOpenSound)
+	n := 0
+	for n < 5000 {
+		f, err := s.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != server.TypeSoundData {
+			t.Fatalf("expect the sound, but got %v", f.Type)
+		}
+		n += len(f.Value)
+	}
+	recv(t, s, server.TypeCloseSound)
+
+	// the device drops
+	d.Close()
+	select {
+	case err = <-errs:
+		if err != ErrConnectionGone {
+			t.Errorf("expect %v, but got %v", ErrConnectionGone, err)
+		}
+	case <-ctx.Done():
+		t.Fatal("wait the error timeout")
+	}
+	if _, err = c.Ping(ctx); err != ErrConnectionGone {
+		t.Errorf("expect %v, but got %v", ErrConnectionGone, err)
+	}
+
+	c.Close()
+	if err = c.Send(ctx, server.TypeMessage, nil); err != ErrClosed {
+		t.Errorf("expect %v, but got %v", ErrClosed, err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv, _, addr := startServer(t, server.Config{ResumeGrace: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	// the session expires before reconnecting with a grace of 0
+	c, err := Dial(ctx, addr, Config{MinBackoff: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	drop := func() {
+		c.mu.Lock()
+		c.conn.Close()
+		c.mu.Unlock()
+	}
+
+	// resumed
+	id := c.Id()
+	drop()
+	if _, err = c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c.Id() != id {
+		t.Errorf("expect the id %d resumed, but got %d", id, c.Id())
+	}
+
+	// expired
+	srv.SetResumeGrace(0)
+	drop()
+	for c.Id() == id {
+		if ctx.Err() != nil {
+			t.Fatal("wait a new session timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err = c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoReconnect(t *testing.T) {
+	_, _, addr := startServer(t, server.Config{})
+	c, err := Dial(context.Background(), addr, Config{NoReconnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.conn.Close()
+	c.mu.Unlock()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("wait closed timeout")
+	}
+	if c.Err() == nil || c.Err() == ErrClosed {
+		t.Errorf("expect the link error, but got %v", c.Err())
+	}
+}
+
+func TestError(t *testing.T) {
+	if s := ErrConnectionGone.Error(); s != "connection gone" {
+		t.Errorf("expect %q, but got %q", "connection gone", s)
+	}
+}
+
+func TestFail(t *testing.T) {
+	c := &Client{}
+	failed := func(w *waiter) error {
+		select {
+		case r := <-w.ch:
+			return r.err
+		default:
+			return nil
+		}
+	}
+
+	// a request is failed before the stream started earlier
+	stream := c.waitStream()
+	ping := c.wait(server.TypePing, nil)
+	if !c.fail(ErrSend) || failed(ping) != ErrSend || failed(stream) != nil {
+		t.Fatal("expect the request failed but the stream")
+	}
+	if !c.fail(ErrSend) || failed(stream) != ErrSend {
+		t.Fatal("expect the stream failed at last")
+	}
+
+	ping = c.wait(server.TypePing, nil)
+	if c.fail(ErrServerShutdown) || failed(ping) != nil {
+		t.Fatalf("expect %v answers nothing", ErrServerShutdown)
+	}
+	stream = c.waitStream()
+	if !c.fail(ErrConnectionGone) || failed(ping) != ErrConnectionGone || failed(stream) != ErrConnectionGone {
+		t.Fatalf("expect %v fails all", ErrConnectionGone)
+	}
+}
+
+func TestHandshakeFrames(t *testing.T) {
+	var scanned []byte
+	config := Config{ScanCode: func(v []byte) { scanned = v }}
+	config.setDefaults()
+	c := &Client{config: config}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		// the request of the session
+		if _, err := util.ReadTLV(c2); err != nil {
+			return
+		}
+		// a broadcast before the reply
+		util.WriteTLV(c2, util.TLV{T: uint64(server.TypeScanCode), L: 1, V: []byte("x")})
+		v, _ := json.Marshal(resumeMessage{Id: 7, Token: "t"})
+		util.WriteTLV(c2, util.TLV{T: uint64(server.TypeResume), L: uint64(len(v)), V: v})
+	}()
+	if err := c.handshake(c1); err != nil {
+		t.Fatal(err)
+	}
+	if c.Id() != 7 || c.token != "t" || string(scanned) != "x" {
+		t.Errorf("unexpected session %d %q with scan code %q", c.Id(), c.token, scanned)
+	}
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/tw4452852/servicemgr/server"
+)
+
+// Error is an error frame from the server or the device, e.g.
+// ErrConnectionGone.
+type Error server.Type
+
+// The error frames of package server.
+var (
+	ErrInternal         = Error(server.ErrorInternal)
+	ErrInvalidType      = Error(server.ErrorInvalidType)
+	ErrConnectionGone   = Error(server.ErrorConnectionGone)
+	ErrSend             = Error(server.ErrorSend)
+	ErrPermissionDenied = Error(server.ErrorPermissionDenied)
+	ErrTooManyClients   = Error(server.ErrorTooManyClients)
+	ErrInvalidData      = Error(server.ErrorInvalidData)
+	ErrNameInUse        = Error(server.ErrorNameInUse)
+	ErrSessionExpired   = Error(server.ErrorSessionExpired)
+	ErrExclusiveTaken   = Error(server.ErrorExclusiveTaken)
+	ErrNoSuchClient     = Error(server.ErrorNoSuchClient)
+	ErrServerShutdown   = Error(server.ErrorServerShutdown)
+)
+
+// Error returns the words of the type name, e.g. "connection gone".
+func (e Error) Error() string {
+	name := strings.TrimPrefix(server.Type(e).String(), "Error")
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isError(t server.Type) bool {
+	return t > server.ErrorBegin && t < server.ErrorEnd
+}
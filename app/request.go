@@ -0,0 +1,374 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/tw4452852/servicemgr/device"
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// The format of the sound, the same as the one the server requests from
+// the device (see server.AudioFormat).
+const (
+	SoundRate    = 44100
+	SoundChannel = 2
+	// SoundInterval is the interval of the sound frames by default.
+	SoundInterval = 20 * time.Millisecond
+)
+
+type result struct {
+	v   []byte
+	err error
+}
+
+// waiter waits for a frame of type want, with value if it isn't nil.
+//
+// The server doesn't tell which request an error frame answers, so it
+// fails a waiter by guess, see fail.
+type waiter struct {
+	want  server.Type
+	value []byte
+	// it waits for the errors of a stream only, see PlaySound
+	stream bool
+	ch     chan result
+}
+
+// ping is the value of TypePing, the ones with Heartbeat are from the
+// server, the others are the replies to Ping echoed by the device.
+type ping struct {
+	Heartbeat uint64 `json:"heartbeat,omitempty"`
+	Ping      uint64 `json:"ping,omitempty"`
+}
+
+// handle dispatches the frame tlv read from conn.
+func (c *Client) handle(conn net.Conn, tlv util.TLV) {
+	t := server.Type(tlv.T)
+	switch {
+	case t == server.TypePing:
+		if c.resolve(t, tlv.V) {
+			return
+		}
+		var p ping
+		if json.Unmarshal(tlv.V, &p) == nil && p.Heartbeat != 0 {
+			c.wmu.Lock()
+			err := util.WriteTLV(conn, tlv)
+			c.wmu.Unlock()
+			if err != nil {
+				c.config.Logger.Warn("answer ping failed", "err", err)
+			}
+		}
+	case isError(t):
+		if c.fail(Error(t)) {
+			return
+		}
+		if c.config.Error != nil {
+			c.config.Error(Error(t))
+		} else {
+			c.config.Logger.Warn("error from the server", "err", Error(t))
+		}
+	case t == server.TypeScanCode:
+		if c.config.ScanCode != nil {
+			c.config.ScanCode(tlv.V)
+		}
+	case t == server.TypeMicData:
+		c.resolve(t, nil)
+		if c.config.MicData != nil {
+			c.config.MicData(tlv.V)
+		}
+	default:
+		if !c.resolve(t, tlv.V) && c.config.Frame != nil {
+			c.config.Frame(t, tlv.V)
+		}
+	}
+}
+
+// resolve passes v to the first waiter of type t, and reports whether
+// there is one.
+func (c *Client) resolve(t server.Type, v []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.waiters {
+		if w.want == t && (w.value == nil || bytes.Equal(w.value, v)) {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			w.ch <- result{v: v}
+			return true
+		}
+	}
+	return false
+}
+
+// fail passes the error frame err to the waiters it answers, and reports
+// whether there is one:
+//   - ErrServerShutdown answers none, the requests are sent again after
+//     reconnecting.
+//   - ErrConnectionGone fails all, as nothing comes from the device any
+//     more.
+//   - The others fail the oldest request, or the oldest stream if there
+//     isn't a request, as a stream waits all along.
+func (c *Client) fail(err Error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch err {
+	case ErrServerShutdown:
+		return false
+	case ErrConnectionGone:
+		for _, w := range c.waiters {
+			w.ch <- result{err: err}
+		}
+		n := len(c.waiters)
+		c.waiters = nil
+		return n > 0
+	}
+
+	i := -1
+	for j, w := range c.waiters {
+		if !w.stream {
+			i = j
+			break
+		}
+		if i < 0 {
+			i = j
+		}
+	}
+	if i < 0 {
+		return false
+	}
+	w := c.waiters[i]
+	c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+	w.ch <- result{err: err}
+	return true
+}
+
+func (c *Client) wait(t server.Type, value []byte) *waiter {
+	return c.add(&waiter{want: t, value: value, ch: make(chan result, 1)})
+}
+
+// waitStream waits for the errors of a stream.
+func (c *Client) waitStream() *waiter {
+	// no frame is of TypeEnd, so only the errors reach it
+	return c.add(&waiter{want: server.TypeEnd, stream: true, ch: make(chan result, 1)})
+}
+
+func (c *Client) add(w *waiter) *waiter {
+	c.mu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	return w
+}
+
+func (c *Client) forget(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.waiters {
+		if c.waiters[i] == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Send sends a frame of type t with value v, it waits for the link to be
+// up if it's reconnecting.
+func (c *Client) Send(ctx context.Context, t server.Type, v []byte) error {
+	return c.write(ctx, util.TLV{T: uint64(t), L: uint64(len(v)), V: v})
+}
+
+// write writes tlv, it's written again after reconnecting if the link
+// drops meanwhile.
+func (c *Client) write(ctx context.Context, tlv util.TLV) error {
+	for {
+		c.mu.Lock()
+		conn, up := c.conn, c.up
+		c.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if conn == nil {
+			select {
+			case <-up:
+			case <-c.done:
+				return c.err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		c.wmu.Lock()
+		stop := context.AfterFunc(ctx, func() {
+			conn.SetWriteDeadline(time.Now())
+		})
+		err := util.WriteTLV(conn, tlv)
+		canceled := !stop()
+		c.wmu.Unlock()
+		if canceled {
+			// the frame may be cut, so the link has to be renewed
+			c.drop(conn)
+			return ctx.Err()
+		}
+		if err == nil {
+			return nil
+		}
+		c.config.Logger.Debug("write failed, wait the link", "err", err)
+		c.drop(conn)
+	}
+}
+
+// drop closes conn, the link is down until reconnecting.
+func (c *Client) drop(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn.Close()
+	if c.conn == conn {
+		c.conn = nil
+		c.up = make(chan struct{})
+	}
+}
+
+// request sends tlv, then waits for the reply of type t. It's sent again
+// if the link drops before the reply.
+func (c *Client) request(ctx context.Context, tlv util.TLV, t server.Type, value []byte) ([]byte, error) {
+	for {
+		v, err := c.requestOnce(ctx, tlv, t, value)
+		if err != linkDownErr {
+			return v, err
+		}
+	}
+}
+
+func (c *Client) requestOnce(ctx context.Context, tlv util.TLV, t server.Type, value []byte) ([]byte, error) {
+	w := c.wait(t, value)
+	defer c.forget(w)
+	if err := c.write(ctx, tlv); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-w.ch:
+		return r.v, r.err
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ping pings the device through the server, and returns the round trip
+// time.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	c.mu.Lock()
+	c.pingSeq++
+	seq := c.pingSeq
+	c.mu.Unlock()
+	v, err := json.Marshal(ping{Ping: seq})
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err = c.request(ctx, util.TLV{T: uint64(server.TypePing), L: uint64(len(v)), V: v}, server.TypePing, v); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// OpenMic opens the mic of the device, and returns once the first pcm
+// arrives at MicData. The mic is opened again after reconnecting if the
+// session isn't resumed.
+func (c *Client) OpenMic(ctx context.Context) error {
+	c.mu.Lock()
+	c.mic = true
+	c.mu.Unlock()
+	_, err := c.request(ctx, util.TLV{T: uint64(server.TypeOpenMic)}, server.TypeMicData, nil)
+	if err != nil {
+		c.mu.Lock()
+		c.mic = false
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// CloseMic closes the mic of the device.
+func (c *Client) CloseMic(ctx context.Context) error {
+	c.mu.Lock()
+	c.mic = false
+	c.mu.Unlock()
+	return c.Send(ctx, server.TypeCloseMic, nil)
+}
+
+// PlaySound plays the 16 bit pcm read from r in the sound format on the
+// device, until r ends or ctx is done. It stops early at an error frame.
+func (c *Client) PlaySound(ctx context.Context, r io.Reader) error {
+	w := c.waitStream()
+	defer func() { c.forget(w) }()
+	if err := c.Send(ctx, server.TypeOpenSound, nil); err != nil {
+		return err
+	}
+	defer func() {
+		// don't wait long for the link if it's reconnecting
+		ctx, cancel := context.WithTimeout(c.ctx, c.config.HandshakeTimeout)
+		defer cancel()
+		c.Send(ctx, server.TypeCloseSound, nil)
+	}()
+
+	size := int(int64(SoundRate)*int64(SoundInterval)/int64(time.Second)) * 2 * SoundChannel
+	ticker := time.NewTicker(SoundInterval)
+	defer ticker.Stop()
+	for {
+		pcm := make([]byte, size)
+		n, err := io.ReadFull(r, pcm)
+		if n > 0 {
+			if err := c.Send(ctx, server.TypeSoundData, pcm[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case r := <-w.ch:
+			if r.err == linkDownErr {
+				// the rest goes to the new link
+				w = c.waitStream()
+				if err := c.Send(ctx, server.TypeOpenSound, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			return r.err
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SendFile transfers the file read from r to the device with name, see
+// device.FileTransfer.
+func (c *Client) SendFile(ctx context.Context, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(device.FileTransfer{Name: name, Data: data})
+	if err != nil {
+		return err
+	}
+	return c.Send(ctx, server.TypeFileTransfer, v)
+}
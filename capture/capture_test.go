@@ -0,0 +1,161 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestWriteRead(t *testing.T) {
+	now := time.Unix(1700000000, 123456000)
+	frames := []Frame{
+		{Time: now, Peer: DevicePeer, TLV: util.TLV{T: 42<<32 | 5, L: 3, V: []byte("abc")}},
+		{Time: now.Add(time.Millisecond), Peer: ClientPeer(42), TLV: util.TLV{T: 7, L: 0, V: []byte{}}},
+		{Time: now.Add(time.Second), Peer: DevicePeer, TLV: util.TLV{T: 1, L: 5, V: []byte("hello")}},
+	}
+
+	var b bytes.Buffer
+	w, err := NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range frames {
+		if err = w.WriteTLV(f.Peer, f.Time, f.TLV); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Len()%4 != 0 {
+		t.Errorf("expect 32 bit aligned blocks, but got %d bytes", b.Len())
+	}
+	// another section concatenated
+	section := b.Len()
+	w, err = NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteTLV(ClientPeer(1), now, frames[0].TLV); err != nil {
+		t.Fatal(err)
+	}
+	frames = append(frames, Frame{Time: now, Peer: ClientPeer(1), TLV: frames[0].TLV})
+
+	r, err := NewReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range frames {
+		f, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.Time.Equal(expect.Time) || f.Peer != expect.Peer || !reflect.DeepEqual(f.TLV, expect.TLV) {
+			t.Errorf("expect %+v, but got %+v", expect, f)
+		}
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Errorf("expect EOF, but got %v", err)
+	}
+
+	// truncated
+	r, err = NewReader(bytes.NewReader(b.Bytes()[:section-2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		_, err = r.Next()
+	}
+	if err != badBlockErr {
+		t.Errorf("expect %v, but got %v", badBlockErr, err)
+	}
+
+	if _, err = NewReader(bytes.NewReader([]byte("not a pcapng file"))); err != notPcapngErr {
+		t.Errorf("expect %v, but got %v", notPcapngErr, err)
+	}
+}
+
+func TestReadBadFrame(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteTLV(DevicePeer, time.Now(), util.TLV{T: 1, L: 4, V: []byte("abcd")}); err != nil {
+		t.Fatal(err)
+	}
+	// claim a huge value in the frame
+	data := b.Bytes()
+	i := bytes.Index(data, []byte("abcd"))
+	binary.BigEndian.PutUint64(data[i-8:], 1<<60)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Next(); err != badFrameErr {
+		t.Errorf("expect %v, but got %v", badFrameErr, err)
+	}
+}
+
+func TestRing(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRing(RingConfig{Dir: dir, MaxSize: 256, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	tlv := util.TLV{T: 1, L: 64, V: make([]byte, 64)}
+	for i := 0; i < 20; i++ {
+		if err = r.WriteTLV(DevicePeer, start.Add(time.Duration(i)*time.Millisecond), tlv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := r.Files()
+	matches, _ := filepath.Glob(filepath.Join(dir, "capture-*.pcapng"))
+	if len(files) != 2 || !reflect.DeepEqual(files, matches) {
+		t.Fatalf("expect 2 files kept, but got %v on disk %v", files, matches)
+	}
+	// every file stands alone
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr, err := NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for ; err == nil; n++ {
+			_, err = cr.Next()
+		}
+		f.Close()
+		if err != io.EOF || n < 2 {
+			t.Errorf("%s: expect frames until EOF, but got %d frames and %v", name, n-1, err)
+		}
+	}
+
+	// by age
+	r, err = NewRing(RingConfig{Dir: dir, Prefix: "age", MaxAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []time.Duration{0, time.Second, time.Minute, 2 * time.Minute} {
+		if err = r.WriteTLV(DevicePeer, time.Now().Add(d), tlv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+	if n := len(r.Files()); n != 3 {
+		t.Errorf("expect 3 files, but got %v", r.Files())
+	}
+}
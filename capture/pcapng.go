@@ -0,0 +1,327 @@
+// Package capture writes the frames forwarded by the server to pcapng
+// files and reads them back.
+//
+// Each peer, the device or a client, is an interface of the section named
+// after it, see DevicePeer and ClientPeer. A packet is a frame on the wire,
+// that is the TLV encoded by util.WriteTLV, with the link type
+// LinkTypeTLV.
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// LinkTypeTLV is the link type of the interfaces, LINKTYPE_USER0.
+const LinkTypeTLV = 147
+
+// DevicePeer is the interface of the frames read from the device.
+const DevicePeer = "device"
+
+// ClientPeer returns the interface of the frames read from client id.
+func ClientPeer(id uint32) string {
+	return fmt.Sprintf("client %d", id)
+}
+
+const (
+	blockSHB = 0x0a0d0d0a
+	blockIDB = 0x00000001
+	blockEPB = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	optEnd      = 0
+	optUserAppl = 4
+	optIfName   = 2
+	optTsResol  = 9
+	optEPBFlags = 2
+
+	// epb_flags of the packets received by the server
+	flagInbound = 1
+
+	// tlvHeaderSize is the size of the type and length of a frame.
+	tlvHeaderSize = 16
+	// maxBlockSize limits the blocks read, as the frames are limited by
+	// the server anyway.
+	maxBlockSize = 64 << 20
+)
+
+var (
+	notPcapngErr   = errors.New("not a pcapng file")
+	badBlockErr    = errors.New("malformed pcapng block")
+	noInterfaceErr = errors.New("packet of an unknown interface")
+	badFrameErr    = errors.New("malformed frame")
+)
+
+// Writer writes the frames as a pcapng section.
+type Writer struct {
+	w      io.Writer
+	ifaces map[string]uint32
+	buf    bytes.Buffer
+}
+
+// NewWriter writes the section header to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	cw := &Writer{w: w, ifaces: make(map[string]uint32)}
+	b := cw.begin(blockSHB)
+	binary.Write(b, binary.LittleEndian, uint32(byteOrderMagic))
+	binary.Write(b, binary.LittleEndian, uint16(1))
+	binary.Write(b, binary.LittleEndian, uint16(0))
+	// the section length isn't known
+	binary.Write(b, binary.LittleEndian, int64(-1))
+	writeOption(b, optUserAppl, []byte("servicemgr"))
+	writeOption(b, optEnd, nil)
+	if err := cw.end(); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// WriteTLV writes tlv read from peer at t.
+func (cw *Writer) WriteTLV(peer string, t time.Time, tlv util.TLV) error {
+	id, ok := cw.ifaces[peer]
+	if !ok {
+		id = uint32(len(cw.ifaces))
+		b := cw.begin(blockIDB)
+		binary.Write(b, binary.LittleEndian, uint16(LinkTypeTLV))
+		binary.Write(b, binary.LittleEndian, uint16(0))
+		// no snap length
+		binary.Write(b, binary.LittleEndian, uint32(0))
+		writeOption(b, optIfName, []byte(peer))
+		// in microseconds
+		writeOption(b, optTsResol, []byte{6})
+		writeOption(b, optEnd, nil)
+		if err := cw.end(); err != nil {
+			return err
+		}
+		cw.ifaces[peer] = id
+	}
+
+	var frame bytes.Buffer
+	if err := util.WriteTLV(&frame, tlv); err != nil {
+		return err
+	}
+	ts := uint64(t.UnixMicro())
+	b := cw.begin(blockEPB)
+	binary.Write(b, binary.LittleEndian, id)
+	binary.Write(b, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(b, binary.LittleEndian, uint32(ts))
+	binary.Write(b, binary.LittleEndian, uint32(frame.Len()))
+	binary.Write(b, binary.LittleEndian, uint32(frame.Len()))
+	b.Write(frame.Bytes())
+	pad(b)
+	var flags [4]byte
+	binary.LittleEndian.PutUint32(flags[:], flagInbound)
+	writeOption(b, optEPBFlags, flags[:])
+	writeOption(b, optEnd, nil)
+	return cw.end()
+}
+
+// begin starts a block of type typ, whose body goes to the returned buffer.
+func (cw *Writer) begin(typ uint32) *bytes.Buffer {
+	cw.buf.Reset()
+	binary.Write(&cw.buf, binary.LittleEndian, typ)
+	// the length is filled by end
+	binary.Write(&cw.buf, binary.LittleEndian, uint32(0))
+	return &cw.buf
+}
+
+// end writes the block begun.
+func (cw *Writer) end() error {
+	n := uint32(cw.buf.Len() + 4)
+	binary.Write(&cw.buf, binary.LittleEndian, n)
+	b := cw.buf.Bytes()
+	binary.LittleEndian.PutUint32(b[4:], n)
+	_, err := cw.w.Write(b)
+	return err
+}
+
+func writeOption(b *bytes.Buffer, code uint16, v []byte) {
+	binary.Write(b, binary.LittleEndian, code)
+	binary.Write(b, binary.LittleEndian, uint16(len(v)))
+	b.Write(v)
+	pad(b)
+}
+
+// pad pads b to 32 bits.
+func pad(b *bytes.Buffer) {
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+// Frame is a frame read from a pcapng file.
+type Frame struct {
+	Time time.Time
+	// Peer is the interface name, see DevicePeer and ClientPeer.
+	Peer string
+	TLV  util.TLV
+}
+
+type iface struct {
+	name     string
+	linkType uint16
+	// units of the timestamps per second
+	resol uint64
+}
+
+// Reader reads the frames of pcapng files, including the ones of the
+// other sections concatenated.
+type Reader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ifaces []iface
+}
+
+// NewReader reads the section header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: r}
+	typ, _, err := cr.block()
+	if err != nil {
+		if err == io.EOF {
+			err = notPcapngErr
+		}
+		return nil, err
+	}
+	if typ != blockSHB {
+		return nil, notPcapngErr
+	}
+	return cr, nil
+}
+
+// Next returns the next frame, or io.EOF at the end.
+func (cr *Reader) Next() (Frame, error) {
+	for {
+		typ, body, err := cr.block()
+		if err != nil {
+			return Frame{}, err
+		}
+		switch typ {
+		case blockSHB:
+			cr.ifaces = nil
+		case blockIDB:
+			if len(body) < 8 {
+				return Frame{}, badBlockErr
+			}
+			i := iface{linkType: cr.order.Uint16(body), resol: 1e6}
+			for code, v := range cr.options(body[8:]) {
+				switch code {
+				case optIfName:
+					i.name = string(v)
+				case optTsResol:
+					if len(v) == 0 {
+						break
+					}
+					base := 10.0
+					if v[0]&0x80 != 0 {
+						base = 2
+					}
+					i.resol = uint64(math.Pow(base, float64(v[0]&0x7f)))
+				}
+			}
+			cr.ifaces = append(cr.ifaces, i)
+		case blockEPB:
+			if len(body) < 20 {
+				return Frame{}, badBlockErr
+			}
+			id := cr.order.Uint32(body)
+			if int(id) >= len(cr.ifaces) {
+				return Frame{}, noInterfaceErr
+			}
+			i := cr.ifaces[id]
+			if i.linkType != LinkTypeTLV {
+				continue
+			}
+			n := cr.order.Uint32(body[12:])
+			if uint64(n) > uint64(len(body)-20) {
+				return Frame{}, badBlockErr
+			}
+			frame := body[20 : 20+n]
+			if n < tlvHeaderSize || binary.BigEndian.Uint64(frame[8:]) != uint64(n-tlvHeaderSize) {
+				return Frame{}, badFrameErr
+			}
+			tlv := util.TLV{
+				T: binary.BigEndian.Uint64(frame),
+				L: uint64(n - tlvHeaderSize),
+				V: frame[tlvHeaderSize:],
+			}
+			ts := uint64(cr.order.Uint32(body[4:]))<<32 | uint64(cr.order.Uint32(body[8:]))
+			sec, frac := ts/i.resol, ts%i.resol
+			return Frame{
+				Time: time.Unix(int64(sec), int64(frac*1e9/i.resol)),
+				Peer: i.name,
+				TLV:  tlv,
+			}, nil
+		}
+	}
+}
+
+// block reads the next block, and returns its type and body.
+func (cr *Reader) block() (uint32, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(cr.r, hdr[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = badBlockErr
+		}
+		return 0, nil, err
+	}
+	// the byte order is known after the section header, which is the same
+	// in both orders
+	if binary.LittleEndian.Uint32(hdr[:]) == blockSHB {
+		if _, err := io.ReadFull(cr.r, hdr[8:]); err != nil {
+			return 0, nil, badBlockErr
+		}
+		switch uint32(byteOrderMagic) {
+		case binary.LittleEndian.Uint32(hdr[8:]):
+			cr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(hdr[8:]):
+			cr.order = binary.BigEndian
+		default:
+			return 0, nil, notPcapngErr
+		}
+	} else if cr.order == nil {
+		return 0, nil, notPcapngErr
+	}
+
+	typ, n := cr.order.Uint32(hdr[:]), cr.order.Uint32(hdr[4:])
+	read := 8
+	if typ == blockSHB {
+		read = 12
+	}
+	if n%4 != 0 || n < uint32(read)+4 || n > maxBlockSize {
+		return 0, nil, badBlockErr
+	}
+	body := make([]byte, int(n)-read)
+	if _, err := io.ReadFull(cr.r, body); err != nil {
+		return 0, nil, badBlockErr
+	}
+	if cr.order.Uint32(body[len(body)-4:]) != n {
+		return 0, nil, badBlockErr
+	}
+	return typ, body[:len(body)-4], nil
+}
+
+// options parses the options in b.
+func (cr *Reader) options(b []byte) map[uint16][]byte {
+	opts := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		code, n := cr.order.Uint16(b), int(cr.order.Uint16(b[2:]))
+		if code == optEnd || 4+n > len(b) {
+			break
+		}
+		opts[code] = b[4 : 4+n]
+		if next := 4 + (n+3)&^3; next < len(b) {
+			b = b[next:]
+		} else {
+			break
+		}
+	}
+	return opts
+}
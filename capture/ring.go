@@ -0,0 +1,145 @@
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+const (
+	DefaultMaxSize  = 64 << 20
+	DefaultMaxFiles = 8
+)
+
+// RingConfig configures a Ring, zero fields take the defaults.
+type RingConfig struct {
+	// Dir is where the files are created.
+	Dir string
+	// Prefix is the prefix of the file names, "capture" if empty.
+	Prefix string
+	// MaxSize is the size in bytes to rotate a file at.
+	MaxSize int64
+	// MaxAge is how long to write a file before rotating it, zero to
+	// rotate by size only. It's checked when a frame is written.
+	MaxAge time.Duration
+	// MaxFiles is the number of files kept, the oldest ones are removed.
+	MaxFiles int
+}
+
+func (c *RingConfig) setDefaults() {
+	if c.Prefix == "" {
+		c.Prefix = "capture"
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = DefaultMaxSize
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = DefaultMaxFiles
+	}
+}
+
+// Ring writes the frames to a ring of pcapng files. It isn't safe for
+// concurrent use.
+type Ring struct {
+	config RingConfig
+	seq    int
+	files  []string
+
+	f       *os.File
+	bw      *bufio.Writer
+	w       *Writer
+	size    int64
+	created time.Time
+}
+
+// NewRing creates the first file of the ring.
+func NewRing(config RingConfig) (*Ring, error) {
+	config.setDefaults()
+	r := &Ring{config: config}
+	if err := r.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// WriteTLV writes tlv read from peer at t, see Writer.WriteTLV.
+func (r *Ring) WriteTLV(peer string, t time.Time, tlv util.TLV) error {
+	if r.size+int64(r.bw.Buffered()) >= r.config.MaxSize || (r.config.MaxAge > 0 && t.Sub(r.created) >= r.config.MaxAge) {
+		if err := r.rotate(t); err != nil {
+			return err
+		}
+	}
+	return r.w.WriteTLV(peer, t, tlv)
+}
+
+// Flush writes the buffered frames to the file.
+func (r *Ring) Flush() error {
+	return r.bw.Flush()
+}
+
+// Files returns the files kept, from the oldest.
+func (r *Ring) Files() []string {
+	return append([]string(nil), r.files...)
+}
+
+// Close flushes and closes the current file.
+func (r *Ring) Close() error {
+	err := r.bw.Flush()
+	if e := r.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// rotate closes the current file if any, and creates the next one at t.
+func (r *Ring) rotate(t time.Time) error {
+	if r.f != nil {
+		if err := r.Close(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		name string
+		f    *os.File
+		err  error
+	)
+	// skip the files of the other rings
+	for f == nil {
+		r.seq++
+		name = filepath.Join(r.config.Dir, fmt.Sprintf("%s-%s-%04d.pcapng", r.config.Prefix, t.Format("20060102T150405"), r.seq))
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	r.f, r.size, r.created = f, 0, t
+	r.bw = bufio.NewWriter(countWriter{r})
+	if r.w, err = NewWriter(r.bw); err != nil {
+		return err
+	}
+
+	r.files = append(r.files, name)
+	for len(r.files) > r.config.MaxFiles {
+		if err = os.Remove(r.files[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.files = r.files[1:]
+	}
+	return nil
+}
+
+// countWriter writes to the file of the ring and counts its size.
+type countWriter struct {
+	r *Ring
+}
+
+func (w countWriter) Write(b []byte) (int, error) {
+	n, err := w.r.f.Write(b)
+	w.r.size += int64(n)
+	return n, err
+}
@@ -7,6 +7,12 @@ import (
 
 var id uint32
 
+// NextId returns a new id from the global counter, which wraps around
+// after 1<<32 clients, so the caller should check whether it's in use.
+func NextId() uint32 {
+	return atomic.AddUint32(&id, 1)
+}
+
 type Client struct {
 	id uint32
 	io.ReadWriteCloser
@@ -14,15 +20,15 @@ type Client struct {
 
 func NewClient(rwc io.ReadWriteCloser) *Client {
 	return &Client{
-		id:              atomic.AddUint32(&id, 1),
+		id:              NextId(),
 		ReadWriteCloser: rwc,
 	}
 }
 
 func (c *Client) Id() uint32 {
-	return c.id
+	return atomic.LoadUint32(&c.id)
 }
 
 func (c *Client) SetId(id uint32) {
-	c.id = id
+	atomic.StoreUint32(&c.id, id)
 }
@@ -0,0 +1,69 @@
+// Command devicesim simulates the device of servicemgr, driven by a script
+// (see Script). It dials the device port of the server, answers the audio
+// requests and the pings, streams the mic to the clients opening it, sends
+// the scan codes on schedule or read from stdin, and receives the files
+// transferred.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tw4452852/servicemgr/device"
+)
+
+func main() {
+	addr := flag.String("s", "localhost:22222", "server listen address of the devices")
+	scriptFile := flag.String("script", "", "script file, empty to accept the audio and stream a sine to the mic")
+	stdin := flag.Bool("stdin", false, "send the lines read from stdin as scan codes")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	data := []byte("{}")
+	if *scriptFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(*scriptFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	script, err := parseScript(data)
+	if err != nil {
+		log.Fatalf("%s: %s", *scriptFile, err)
+	}
+
+	s, err := newSim(script, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	d, err := device.Dial(ctx, *addr, s.config())
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.Info("connected", "server", *addr)
+
+	var in io.Reader
+	if *stdin {
+		in = os.Stdin
+	}
+	if err = s.run(ctx, d, in); err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "devicesim: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+
+	"github.com/tw4452852/servicemgr/device"
+)
+
+var badWAVErr = errors.New("not a 16 bit pcm wav file")
+
+// The sources of the mic read 16 bit little endian pcm in the mic format
+// endlessly, they never fail.
+
+type sine struct {
+	step, amplitude float64
+	phase           float64
+}
+
+func (s *sine) Read(b []byte) (int, error) {
+	for i := 0; i+2*device.MicChannel <= len(b); i += 2 * device.MicChannel {
+		v := int16(s.amplitude * math.MaxInt16 * math.Sin(s.phase))
+		for c := 0; c < device.MicChannel; c++ {
+			binary.LittleEndian.PutUint16(b[i+2*c:], uint16(v))
+		}
+		s.phase = math.Mod(s.phase+s.step, 2*math.Pi)
+	}
+	return len(b), nil
+}
+
+type noise struct {
+	amplitude float64
+	rand      *rand.Rand
+}
+
+func (n *noise) Read(b []byte) (int, error) {
+	for i := 0; i+2 <= len(b); i += 2 {
+		v := int16(n.amplitude * math.MaxInt16 * (2*n.rand.Float64() - 1))
+		binary.LittleEndian.PutUint16(b[i:], uint16(v))
+	}
+	return len(b), nil
+}
+
+// loop plays pcm in loop.
+type loop struct {
+	pcm []byte
+	off int
+}
+
+func (l *loop) Read(b []byte) (int, error) {
+	for off := 0; off < len(b); {
+		n := copy(b[off:], l.pcm[l.off:])
+		off += n
+		l.off = (l.off + n) % len(l.pcm)
+	}
+	return len(b), nil
+}
+
+// newSource returns a new source of m, whose wav is read already.
+func newSource(m Mic, wav []byte) io.Reader {
+	switch m.Source {
+	case micNoise:
+		return &noise{amplitude: m.Amplitude, rand: rand.New(rand.NewSource(rand.Int63()))}
+	case micWAV:
+		return &loop{pcm: wav}
+	default:
+		return &sine{step: 2 * math.Pi * m.Frequency / device.MicRate, amplitude: m.Amplitude}
+	}
+}
+
+// readWAV reads the 16 bit pcm of the wav file, and its rate and channel.
+func readWAV(name string) (pcm []byte, rate, channel int, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return parseWAV(data)
+}
+
+func parseWAV(data []byte) (pcm []byte, rate, channel int, err error) {
+	r := bytes.NewReader(data)
+	var riff struct {
+		ID   [4]byte
+		Size uint32
+		Wave [4]byte
+	}
+	if err = binary.Read(r, binary.LittleEndian, &riff); err != nil || string(riff.ID[:]) != "RIFF" || string(riff.Wave[:]) != "WAVE" {
+		return nil, 0, 0, badWAVErr
+	}
+
+	var fmtFound bool
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err = binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return nil, 0, 0, badWAVErr
+		}
+		if int64(chunk.Size) > int64(r.Len()) {
+			return nil, 0, 0, badWAVErr
+		}
+		body := make([]byte, chunk.Size)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return nil, 0, 0, badWAVErr
+		}
+		// chunks are word aligned
+		if chunk.Size%2 == 1 {
+			r.ReadByte()
+		}
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, 0, badWAVErr
+			}
+			format := binary.LittleEndian.Uint16(body)
+			channel = int(binary.LittleEndian.Uint16(body[2:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits := binary.LittleEndian.Uint16(body[14:])
+			if format != 1 || bits != 16 || channel == 0 {
+				return nil, 0, 0, badWAVErr
+			}
+			fmtFound = true
+		case "data":
+			if !fmtFound || len(body) < 2*channel {
+				return nil, 0, 0, badWAVErr
+			}
+			return body[:len(body)/(2*channel)*(2*channel)], rate, channel, nil
+		}
+	}
+}
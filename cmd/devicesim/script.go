@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tw4452852/servicemgr/device"
+)
+
+// duration is a time.Duration in json, e.g. "1.5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Answers of the audio requests of the server.
+const (
+	audioAccept = "accept"
+	audioRefuse = "refuse"
+	audioIgnore = "ignore"
+)
+
+// Sources of the mic.
+const (
+	micSine  = "sine"
+	micNoise = "noise"
+	micWAV   = "wav"
+)
+
+// Script is the scenario of the simulator, in json:
+//
+//	{
+//		"audio": "refuse",
+//		"acceptAudioAfter": 2,
+//		"mic": {"source": "sine", "frequency": 440, "amplitude": 0.5},
+//		"fileDir": "received",
+//		"scanCodes": [
+//			{"after": "1s", "value": "{\"type\":\"scanRes\",\"result\":\"0\",\"scanData\":\"xxxxx\"}"},
+//			{"after": "2s", "every": "1s", "count": 10, "to": 4294967295, "value": "..."}
+//		]
+//	}
+type Script struct {
+	// Audio answers the audio requests of the server: accept (the
+	// default), refuse or ignore.
+	Audio string `json:"audio"`
+	// AcceptAudioAfter accepts the audio after so many requests answered
+	// by Audio.
+	AcceptAudioAfter int `json:"acceptAudioAfter"`
+	// Mic is streamed to a client between its TypeOpenMic and
+	// TypeCloseMic.
+	Mic Mic `json:"mic"`
+	// FileDir is where the files transferred are written, they are
+	// dropped if empty.
+	FileDir string `json:"fileDir"`
+	// ScanCodes are sent on schedule.
+	ScanCodes []ScanCode `json:"scanCodes"`
+}
+
+// Mic is the synthetic mic, in 16 bit pcm.
+type Mic struct {
+	// Source is sine (the default), noise or wav.
+	Source string `json:"source"`
+	// Frequency of the sine in Hz, 440 by default.
+	Frequency float64 `json:"frequency"`
+	// Amplitude of the sine or the noise in full scale, 0.5 by default.
+	Amplitude float64 `json:"amplitude"`
+	// File is the wav file played in loop.
+	File string `json:"file"`
+	// Interval between the frames, 20ms by default.
+	Interval duration `json:"interval"`
+}
+
+// ScanCode is a scan code sent after the start, and every interval for
+// count times if any. It's sent every interval forever if count is 0.
+type ScanCode struct {
+	After duration `json:"after"`
+	Every duration `json:"every"`
+	Count int      `json:"count"`
+	// To is the address, 0 for the subscribers of TypeScanCode, see
+	// server.BroadcastAddress and server.GroupAddress.
+	To    uint32 `json:"to"`
+	Value string `json:"value"`
+}
+
+// parseScript parses and checks the script in data, and fills the
+// defaults.
+func parseScript(data []byte) (*Script, error) {
+	s := &Script{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Script) check() error {
+	switch s.Audio {
+	case "":
+		s.Audio = audioAccept
+	case audioAccept, audioRefuse, audioIgnore:
+	default:
+		return fmt.Errorf("unknown audio answer %q", s.Audio)
+	}
+
+	m := &s.Mic
+	switch m.Source {
+	case "":
+		m.Source = micSine
+	case micSine, micNoise:
+	case micWAV:
+		if m.File == "" {
+			return fmt.Errorf("no wav file of the mic")
+		}
+	default:
+		return fmt.Errorf("unknown mic source %q", m.Source)
+	}
+	if m.Frequency <= 0 {
+		m.Frequency = 440
+	}
+	if m.Amplitude <= 0 || m.Amplitude > 1 {
+		m.Amplitude = 0.5
+	}
+	if m.Interval <= 0 {
+		m.Interval = duration(device.MicInterval)
+	}
+
+	for i, sc := range s.ScanCodes {
+		if sc.After < 0 || sc.Every < 0 || sc.Count < 0 {
+			return fmt.Errorf("scan code %d: negative schedule", i)
+		}
+		if sc.Count > 0 && sc.Every == 0 {
+			return fmt.Errorf("scan code %d: count without every", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/device"
+	"github.com/tw4452852/servicemgr/server"
+)
+
+// sim runs a script on the device end of the link.
+type sim struct {
+	script *Script
+	// the pcm of the wav source
+	wav []byte
+	log *slog.Logger
+
+	// the audio requests answered
+	audioRequests int
+	// the files received
+	files atomic.Int64
+}
+
+func newSim(script *Script, log *slog.Logger) (*sim, error) {
+	s := &sim{script: script, log: log}
+	if script.Mic.Source == micWAV {
+		pcm, rate, channel, err := readWAV(script.Mic.File)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", script.Mic.File, err)
+		}
+		if rate != device.MicRate || channel != device.MicChannel {
+			log.Warn("wav format differs from the mic, sent as is", "rate", rate, "channel", channel)
+		}
+		s.wav = pcm
+	}
+	return s, nil
+}
+
+// config returns the config of the device running the script.
+func (s *sim) config() device.Config {
+	return device.Config{Audio: s.answerAudio, Logger: s.log}
+}
+
+// run runs the script on d until ctx is done or the link fails, the scan
+// codes read from stdin are sent too if it isn't nil. d is closed when it
+// returns.
+func (s *sim) run(ctx context.Context, d *device.Device, stdin io.Reader) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer d.Close()
+
+	for _, sc := range s.script.ScanCodes {
+		sc := sc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.schedule(ctx, d, sc)
+		}()
+	}
+	if stdin != nil {
+		go s.readStdin(d, stdin)
+	}
+
+	for {
+		sess, err := d.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, sess)
+		}()
+	}
+}
+
+// answerAudio answers an audio request per the script.
+func (s *sim) answerAudio(server.AudioFormat) device.AudioAnswer {
+	s.audioRequests++
+	answer := s.script.Audio
+	if s.script.AcceptAudioAfter > 0 && s.audioRequests > s.script.AcceptAudioAfter {
+		answer = audioAccept
+	}
+	s.log.Info("audio requested", "answer", answer, "requests", s.audioRequests)
+	switch answer {
+	case audioAccept:
+		return device.AudioAccept
+	case audioRefuse:
+		return device.AudioRefuse
+	}
+	return device.AudioIgnore
+}
+
+// schedule sends the scan code per its schedule until ctx is done.
+func (s *sim) schedule(ctx context.Context, d *device.Device, sc ScanCode) {
+	timer := time.NewTimer(time.Duration(sc.After))
+	defer timer.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		s.sendScanCode(d, sc.To, sc.Value)
+		if sc.Every == 0 || (sc.Count > 0 && n+1 >= sc.Count) {
+			return
+		}
+		timer.Reset(time.Duration(sc.Every))
+	}
+}
+
+// readStdin sends the lines of r as the scan codes to the subscribers.
+func (s *sim) readStdin(d *device.Device, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			s.sendScanCode(d, 0, line)
+		}
+	}
+}
+
+func (s *sim) sendScanCode(d *device.Device, to uint32, value string) {
+	if err := d.SendScanCode(to, []byte(value)); err != nil {
+		s.log.Warn("send scan code failed", "to", to, "err", err)
+		return
+	}
+	s.log.Info("scan code sent", "to", to)
+}
+
+// serve handles the frames of a client until ctx is done or the link
+// fails. The mic is streamed to it between TypeOpenMic and TypeCloseMic.
+func (s *sim) serve(ctx context.Context, sess *device.Session) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var closeMic context.CancelFunc
+	defer func() {
+		if closeMic != nil {
+			closeMic()
+		}
+	}()
+
+	id := sess.Id()
+	for {
+		f, err := sess.Recv(ctx)
+		if err != nil {
+			return
+		}
+
+		switch f.Type {
+		case server.TypeOpenMic:
+			if closeMic != nil {
+				continue
+			}
+			mic, cancel := context.WithCancel(ctx)
+			closeMic = cancel
+			s.log.Info("mic opened", "client", id, "source", s.script.Mic.Source)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := sess.StreamMic(mic, newSource(s.script.Mic, s.wav), time.Duration(s.script.Mic.Interval))
+				if err != nil && mic.Err() == nil {
+					s.log.Warn("send mic data failed", "client", id, "err", err)
+				}
+			}()
+		case server.TypeCloseMic:
+			if closeMic != nil {
+				closeMic()
+				closeMic = nil
+				s.log.Info("mic closed", "client", id)
+			}
+		case server.TypeFileTransfer:
+			s.receiveFile(id, f.Value)
+		default:
+			s.log.Debug("frame skipped", "client", id, "type", f.Type)
+		}
+	}
+}
+
+// receiveFile writes the file transferred by client id to the file dir.
+func (s *sim) receiveFile(id uint32, v []byte) {
+	n := s.files.Add(1)
+	f := device.ParseFileTransfer(v)
+	// never out of the dir
+	switch f.Name = filepath.Base(f.Name); f.Name {
+	case ".", "..", string(filepath.Separator):
+		f.Name = fmt.Sprintf("client-%d-%d.bin", id, n)
+	}
+	if s.script.FileDir == "" {
+		s.log.Info("file dropped", "client", id, "name", f.Name, "size", len(f.Data))
+		return
+	}
+	name := filepath.Join(s.script.FileDir, f.Name)
+	if err := os.MkdirAll(s.script.FileDir, 0755); err != nil {
+		s.log.Warn("create file dir failed", "err", err)
+		return
+	}
+	if err := ioutil.WriteFile(name, f.Data, 0644); err != nil {
+		s.log.Warn("write file failed", "client", id, "name", name, "err", err)
+		return
+	}
+	s.log.Info("file received", "client", id, "name", name, "size", len(f.Data))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/device"
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestParseScript(t *testing.T) {
+	s, err := parseScript([]byte(`{"scanCodes": [{"after": "1s", "every": "500ms", "count": 2, "value": "x"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Audio != audioAccept || s.Mic.Source != micSine || s.Mic.Interval != duration(20*time.Millisecond) {
+		t.Errorf("expect the defaults, but got %+v", s)
+	}
+	if sc := s.ScanCodes[0]; sc.After != duration(time.Second) || sc.Every != duration(500*time.Millisecond) {
+		t.Errorf("unexpected %+v", sc)
+	}
+
+	for _, bad := range []string{
+		`{"audio": "maybe"}`,
+		`{"mic": {"source": "wav"}}`,
+		`{"scanCodes": [{"count": 2}]}`,
+		`{"scanCodes": [{"after": "soon"}]}`,
+	} {
+		if _, err = parseScript([]byte(bad)); err == nil {
+			t.Errorf("%s: expect error", bad)
+		}
+	}
+}
+
+func TestParseWAV(t *testing.T) {
+	var b bytes.Buffer
+	pcm := []byte{1, 0, 2, 0, 3, 0, 4, 0, 5}
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.WriteString("WAVE")
+	b.WriteString("LIST")
+	binary.Write(&b, binary.LittleEndian, uint32(3))
+	b.WriteString("abc\x00")
+	b.WriteString("fmt ")
+	binary.Write(&b, binary.LittleEndian, []uint32{16, 1 | 2<<16, 8000, 32000, 4 | 16<<16})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(pcm)))
+	b.Write(pcm)
+
+	v, rate, channel, err := parseWAV(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 8000 || channel != 2 || !bytes.Equal(v, pcm[:8]) {
+		t.Errorf("unexpected %v %d %d", v, rate, channel)
+	}
+	if _, _, _, err = parseWAV([]byte("RIFF")); err != badWAVErr {
+		t.Errorf("expect %v, but got %v", badWAVErr, err)
+	}
+	// a chunk larger than the file isn't allocated
+	huge := []byte("RIFF\x00\x00\x00\x00WAVEdata\xff\xff\xff\xff")
+	if _, _, _, err = parseWAV(huge); err != badWAVErr {
+		t.Errorf("expect %v, but got %v", badWAVErr, err)
+	}
+}
+
+func TestSim(t *testing.T) {
+	dir := t.TempDir()
+	script, err := parseScript([]byte(`{
+		"audio": "refuse",
+		"acceptAudioAfter": 1,
+		"mic": {"interval": "5ms"},
+		"fileDir": "` + dir + `",
+		"scanCodes": [{"every": "5ms", "count": 2, "to": 42, "value": "scanned"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverEnd, deviceEnd := net.Pipe()
+	defer serverEnd.Close()
+	s, err := newSim(script, slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := device.New(deviceEnd, s.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.run(ctx, d, strings.NewReader("typed\n")) }()
+
+	// read until a frame of type typ
+	read := func(typ server.Type) util.TLV {
+		t.Helper()
+		serverEnd.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			v, err := util.ReadTLV(serverEnd)
+			if err != nil {
+				t.Fatalf("wait %v: %s", typ, err)
+			}
+			if server.Type(v.T&0xffffffff) == typ {
+				return v
+			}
+		}
+	}
+	write := func(v util.TLV) {
+		t.Helper()
+		if err := util.WriteTLV(serverEnd, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]int{}
+	for len(seen) < 2 || seen["scanned"] < 2 {
+		v := read(server.TypeScanCode)
+		if string(v.V) == "scanned" && v.T>>32 != 42 {
+			t.Errorf("expect the scan code to 42, but got %v", v)
+		}
+		seen[string(v.V)]++
+	}
+
+	write(util.TLV{T: uint64(server.TypeOpenSound), L: 2, V: []byte("{}")})
+	if v := read(server.ErrorInvalidData); v.T != uint64(server.ErrorInvalidData) {
+		t.Errorf("expect refused, but got %v", v)
+	}
+	write(util.TLV{T: uint64(server.TypeOpenSound), L: 2, V: []byte("{}")})
+	read(server.TypeOpenSound)
+
+	ping := util.TLV{T: uint64(server.ServerAddress)<<32 | uint64(server.TypePing), L: 2, V: []byte("{}")}
+	write(ping)
+	if v := read(server.TypePing); v.T != ping.T {
+		t.Errorf("expect the ping echoed, but got %v", v)
+	}
+
+	clientPing := util.TLV{T: 7<<32 | uint64(server.TypePing), L: 2, V: []byte("{}")}
+	write(clientPing)
+	if v := read(server.TypePing); v.T != clientPing.T {
+		t.Errorf("expect the ping of the client echoed, but got %v", v)
+	}
+
+	write(util.TLV{T: 7<<32 | uint64(server.TypeOpenMic)})
+	v := read(server.TypeMicData)
+	if v.T>>32 != 7 || len(v.V) != 220*4 {
+		t.Errorf("expect 5ms of mic to 7, but got %v", v)
+	}
+	write(util.TLV{T: 7<<32 | uint64(server.TypeCloseMic)})
+
+	file, _ := json.Marshal(device.FileTransfer{Name: "../a.txt", Data: []byte("hello")})
+	write(util.TLV{T: 7<<32 | uint64(server.TypeFileTransfer), L: uint64(len(file)), V: file})
+	write(util.TLV{T: 7<<32 | uint64(server.TypeFileTransfer), L: 3, V: []byte("raw")})
+	for name, expect := range map[string]string{"a.txt": "hello", "client-7-2.bin": "raw"} {
+		var data []byte
+		// written by the session of the client in the background
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if data, err = ioutil.ReadFile(filepath.Join(dir, name)); err == nil && string(data) == expect {
+				break
+			}
+		}
+		if err != nil || string(data) != expect {
+			t.Errorf("%s: expect %q, but got %q, %v", name, expect, data, err)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expect %v, but got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait the sim timeout")
+	}
+}
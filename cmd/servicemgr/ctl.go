@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tw4452852/servicemgr/server"
+)
+
+const ctlUsage = `usage: servicemgr ctl [flags] <command> [args]
+
+commands:
+  clients                         list the clients
+  kick <id>                       disconnect a client
+  device                          show the device status
+  reconnect                       drop the device link for it to reconnect
+  audio on|off                    turn on or off the audio of the device
+  loglevel                        show the log levels
+  loglevel <level>                set the default log level
+  loglevel <subsystem> <level>    set the level of a subsystem
+  loglevel client <id> <level>    set the level of a client, level reset drops it
+  send --type <type> --to <to>    send a frame to the device or a client by id or name
+  tap [--client <id>] [--type <types>] [--direction <from_device|from_client>]
+                                  stream the frames until interrupted
+  capture                         show the status of the capture
+  capture start [--client <id>] [--type <types>] [--direction <direction>]
+                [--max-size <bytes>] [--max-age <duration>] [--max-files <n>]
+                                  capture the frames to pcapng files, see servicemgr decode
+  capture stop                    stop the capture
+
+flags (before or after the command):
+`
+
+// ctl talks to a running server over its debug listener or admin socket.
+type ctl struct {
+	addr      string
+	socket    string
+	tokenFile string
+	json      bool
+
+	token  string
+	client *http.Client
+	out    io.Writer
+}
+
+// flags returns the flag set of command name with the common flags.
+func (c *ctl) flags(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.addr, "addr", c.addr, "debug listen address of the server")
+	fs.StringVar(&c.socket, "socket", c.socket, "admin socket of the server, instead of the debug listener")
+	fs.StringVar(&c.tokenFile, "token-file", c.tokenFile, "admin token file for the debug listener")
+	fs.BoolVar(&c.json, "json", c.json, "print the raw json")
+	return fs
+}
+
+// runCtl runs the ctl command with args, and returns the exit code.
+func runCtl(args []string, stdout, stderr io.Writer) int {
+	c := &ctl{addr: "localhost:22224", out: stdout}
+	fs := c.flags("ctl", stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, ctlUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	err := c.run(fs.Arg(0), fs.Args()[1:], stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "servicemgr ctl: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (c *ctl) run(name string, args []string, stderr io.Writer) error {
+	fs := c.flags(name, stderr)
+	var (
+		typ, to, value, client, direction string
+		maxSize, maxFiles                 int
+		maxAge                            time.Duration
+	)
+	switch name {
+	case "send":
+		fs.StringVar(&typ, "type", "", "type of the frame, e.g. TypePing")
+		fs.StringVar(&to, "to", "device", "device, or a client id or name")
+		fs.StringVar(&value, "value", "", "value of the frame")
+	case "tap", "capture":
+		fs.StringVar(&client, "client", "", "client id of the frames")
+		fs.StringVar(&typ, "type", "", "comma separated types of the frames")
+		fs.StringVar(&direction, "direction", "", "from_device or from_client")
+	}
+	if name == "capture" {
+		fs.IntVar(&maxSize, "max-size", 0, "size in bytes to rotate a file at, 0 for the default")
+		fs.DurationVar(&maxAge, "max-age", 0, "how long to write a file before rotating it, 0 to rotate by size only")
+		fs.IntVar(&maxFiles, "max-files", 0, "number of files kept, 0 for the default")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	switch name {
+	case "clients":
+		var clients []server.ClientInfo
+		return c.do("GET", "/admin/clients", nil, &clients, func() { c.printClients(clients) })
+	case "kick":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: kick <id>")
+		}
+		return c.do("POST", "/admin/clients/"+url.PathEscape(args[0])+"/disconnect", nil, nil, func() {
+			fmt.Fprintf(c.out, "client %s disconnected\n", args[0])
+		})
+	case "device":
+		var st server.Status
+		return c.do("GET", "/admin/device", nil, &st, func() { c.printStatus(st) })
+	case "reconnect":
+		return c.do("POST", "/admin/device/reconnect", nil, nil, func() {
+			fmt.Fprintln(c.out, "device dropped")
+		})
+	case "audio":
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return fmt.Errorf("usage: audio on|off")
+		}
+		on := strconv.FormatBool(args[0] == "on")
+		return c.do("POST", "/admin/device/audio?on="+on, nil, nil, func() {
+			fmt.Fprintf(c.out, "audio %s requested\n", args[0])
+		})
+	case "loglevel":
+		return c.loglevel(args)
+	case "send":
+		if typ == "" || len(args) != 0 {
+			return fmt.Errorf("usage: send --type <type> [--to <to>] [--value <value>]")
+		}
+		q := url.Values{"type": {typ}, "to": {to}}
+		return c.do("POST", "/admin/send?"+q.Encode(), strings.NewReader(value), nil, func() {
+			fmt.Fprintf(c.out, "%s sent to %s\n", typ, to)
+		})
+	case "tap":
+		q := filterQuery(client, typ, direction)
+		if c.json {
+			q.Set("format", "json")
+		}
+		return c.stream("/admin/tap?" + q.Encode())
+	case "capture":
+		var st server.CaptureStatus
+		show := func() { c.printCapture(st) }
+		switch {
+		case len(args) == 0:
+			return c.do("GET", "/admin/capture", nil, &st, show)
+		case len(args) == 1 && args[0] == "start":
+			q := filterQuery(client, typ, direction)
+			if maxSize > 0 {
+				q.Set("maxSize", strconv.Itoa(maxSize))
+			}
+			if maxAge > 0 {
+				q.Set("maxAge", maxAge.String())
+			}
+			if maxFiles > 0 {
+				q.Set("maxFiles", strconv.Itoa(maxFiles))
+			}
+			return c.do("POST", "/admin/capture/start?"+q.Encode(), nil, nil, func() {
+				fmt.Fprintln(c.out, "capture started")
+			})
+		case len(args) == 1 && args[0] == "stop":
+			return c.do("POST", "/admin/capture/stop", nil, &st, show)
+		default:
+			return fmt.Errorf("usage: capture [start|stop]")
+		}
+	default:
+		return fmt.Errorf("unknown command %q, see servicemgr ctl -h", name)
+	}
+}
+
+// init sets up the http client for the debug listener or the admin socket.
+func (c *ctl) init() error {
+	c.client = &http.Client{Timeout: 10 * time.Second}
+	if c.socket != "" {
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.socket)
+			},
+		}
+		c.addr = "admin"
+		return nil
+	}
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		c.token = string(bytes.TrimSpace(token))
+	}
+	return nil
+}
+
+// do sends the request, then either prints the raw json with --json or
+// decodes it into v and calls show.
+func (c *ctl) do(method, path string, body io.Reader, v interface{}, show func()) error {
+	req, err := http.NewRequest(method, "http://"+c.addr+path, body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(data))
+	}
+
+	if c.json {
+		var b bytes.Buffer
+		if err = json.Indent(&b, data, "", "  "); err != nil {
+			return err
+		}
+		b.WriteByte('\n')
+		_, err = b.WriteTo(c.out)
+		return err
+	}
+	if v != nil {
+		if err = json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+	show()
+	return nil
+}
+
+// stream copies the response of path to the output until it ends.
+func (c *ctl) stream(path string) error {
+	req, err := http.NewRequest("GET", "http://"+c.addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	client := *c.client
+	client.Timeout = 0
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(data))
+	}
+	_, err = io.Copy(c.out, res.Body)
+	return err
+}
+
+func (c *ctl) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+}
+
+func (c *ctl) printClients(clients []server.ClientInfo) {
+	w := c.table()
+	fmt.Fprintln(w, "ID\tNAME\tREMOTE\tCONNECTED\tBYTES IN\tBYTES OUT\tLAST TYPE")
+	for _, cl := range clients {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", cl.Id, orDash(cl.Name), orDash(cl.Remote),
+			cl.ConnectedAt.Format(time.RFC3339), cl.BytesIn, cl.BytesOut, orDash(cl.LastType))
+	}
+	w.Flush()
+}
+
+func (c *ctl) printStatus(st server.Status) {
+	w := c.table()
+	fmt.Fprintf(w, "STATE\t%v\n", st.State)
+	if !st.Since.IsZero() {
+		fmt.Fprintf(w, "SINCE\t%s\n", st.Since.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "DEVICE\t%s\n", orDash(st.Device))
+	fmt.Fprintf(w, "REMOTE\t%s\n", orDash(st.Remote))
+	if st.Audio != nil {
+		fmt.Fprintf(w, "AUDIO\tformat %d, rate %d, channel %d\n", st.Audio.Format, st.Audio.Rate, st.Audio.Channel)
+	} else {
+		fmt.Fprintf(w, "AUDIO\toff\n")
+	}
+	if h := st.Health; h != nil {
+		fmt.Fprintf(w, "LAST SEEN\t%s\n", h.LastSeen.Format(time.RFC3339))
+		fmt.Fprintf(w, "RTT\t%s\n", h.RTT)
+		fmt.Fprintf(w, "MISSED\t%d\n", h.Missed)
+	}
+	w.Flush()
+
+	if len(st.History) == 0 {
+		return
+	}
+	fmt.Fprintln(c.out)
+	w = c.table()
+	fmt.Fprintln(w, "TIME\tFROM\tTO\tREMOTE\tREASON")
+	for _, t := range st.History {
+		fmt.Fprintf(w, "%s\t%v\t%v\t%s\t%s\n", t.Time.Format(time.RFC3339), t.From, t.To, t.Remote, t.Reason)
+	}
+	w.Flush()
+}
+
+func (c *ctl) printCapture(st server.CaptureStatus) {
+	w := c.table()
+	fmt.Fprintf(w, "RUNNING\t%t\n", st.Running)
+	if !st.Since.IsZero() {
+		fmt.Fprintf(w, "SINCE\t%s\n", st.Since.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "FRAMES\t%d\n", st.Frames)
+	fmt.Fprintf(w, "DROPPED\t%d\n", st.Dropped)
+	if st.Error != "" {
+		fmt.Fprintf(w, "ERROR\t%s\n", st.Error)
+	}
+	for _, f := range st.Files {
+		fmt.Fprintf(w, "FILE\t%s\n", f)
+	}
+	w.Flush()
+}
+
+// filterQuery returns the query of the tap filter, see server.ServeTap.
+func filterQuery(client, typ, direction string) url.Values {
+	q := url.Values{}
+	for k, v := range map[string]string{"client": client, "type": typ, "direction": direction} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	return q
+}
+
+// levels is the json form of the log levels, see logging.Levels.
+type levels struct {
+	Default    string            `json:"default"`
+	Subsystems map[string]string `json:"subsystems"`
+	Clients    map[string]string `json:"clients"`
+}
+
+func (c *ctl) loglevel(args []string) error {
+	q := url.Values{}
+	switch len(args) {
+	case 0:
+		var ls levels
+		return c.do("GET", "/log", nil, &ls, func() { c.printLevels(ls) })
+	case 1:
+		q.Set("level", args[0])
+	case 2:
+		q.Set("subsystem", args[0])
+		q.Set("level", args[1])
+	case 3:
+		if args[0] != "client" {
+			return fmt.Errorf("usage: loglevel client <id> <level>")
+		}
+		q.Set("client", args[1])
+		q.Set("level", args[2])
+	default:
+		return fmt.Errorf("usage: loglevel [[<subsystem>|client <id>] <level>]")
+	}
+	var ls levels
+	return c.do("PUT", "/log?"+q.Encode(), nil, &ls, func() { c.printLevels(ls) })
+}
+
+func (c *ctl) printLevels(ls levels) {
+	w := c.table()
+	fmt.Fprintln(w, "SCOPE\tLEVEL")
+	fmt.Fprintf(w, "default\t%s\n", ls.Default)
+	for _, k := range sortedKeys(ls.Subsystems) {
+		fmt.Fprintf(w, "%s\t%s\n", k, ls.Subsystems[k])
+	}
+	for _, k := range sortedKeys(ls.Clients) {
+		fmt.Fprintf(w, "client %s\t%s\n", k, ls.Clients[k])
+	}
+	w.Flush()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tw4452852/servicemgr/logging"
+	"github.com/tw4452852/servicemgr/server"
+)
+
+func TestCtl(t *testing.T) {
+	srv := server.NewServer(server.Config{DisableAudio: true})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", srv.AdminHandler())
+	mux.Handle("/log", logging.NewLevels(slog.LevelInfo))
+	ts := httptest.NewServer(server.RequireToken("secret", mux))
+	defer ts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	for _, c := range []struct {
+		args   []string
+		code   int
+		expect string
+	}{
+		{[]string{"clients"}, 0, "ID  NAME  REMOTE  CONNECTED  BYTES IN  BYTES OUT  LAST TYPE\n"},
+		{[]string{"device"}, 0, "STATE   accepting\nDEVICE  -\nREMOTE  -\nAUDIO   off\n"},
+		{[]string{"device", "--json"}, 0, `"state": "accepting"`},
+		{[]string{"loglevel", "server", "debug"}, 0, "SCOPE    LEVEL\ndefault  INFO\nserver   DEBUG\n"},
+		{[]string{"loglevel", "client", "42", "warn"}, 0, "client 42  WARN\n"},
+		{[]string{"loglevel", "client", "42"}, 1, ""},
+		{[]string{"kick", "42"}, 1, ""},
+		{[]string{"reconnect"}, 1, ""},
+		{[]string{"send", "--type", "TypePing", "--to", "device"}, 1, ""},
+		{[]string{"send", "--to", "device"}, 1, ""},
+		{[]string{"capture"}, 0, "RUNNING  false\nFRAMES   0\nDROPPED  0\n"},
+		{[]string{"capture", "start", "--type", "TypePing"}, 1, ""},
+		{[]string{"capture", "stop"}, 1, ""},
+		{[]string{"nothing"}, 1, ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-addr", addr, "-token-file", tokenFile}, c.args...)
+		if code := runCtl(args, &stdout, &stderr); code != c.code {
+			t.Errorf("%v: expect exit %d, but got %d: %s", c.args, c.code, code, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), c.expect) {
+			t.Errorf("%v: expect %q in output, but got %q", c.args, c.expect, stdout.String())
+		}
+	}
+
+	// without the token
+	var stdout, stderr bytes.Buffer
+	if code := runCtl([]string{"-addr", addr, "--json", "clients"}, &stdout, &stderr); code != 1 {
+		t.Errorf("expect exit 1 without token, but got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "401") {
+		t.Errorf("expect unauthorized, but got %q", stderr.String())
+	}
+
+	stdout.Reset()
+	if code := runCtl([]string{"-addr", addr, "-token-file", tokenFile, "-json", "loglevel"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expect exit 0, but got %d: %s", code, stderr.String())
+	}
+	var ls levels
+	if err := json.Unmarshal(stdout.Bytes(), &ls); err != nil || ls.Subsystems["server"] != "DEBUG" {
+		t.Errorf("unexpected levels %q: %v", stdout.String(), err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+
+	// not a socket
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path); err == nil {
+		t.Fatal("expect an error on a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expect the file kept, but got %v", err)
+	}
+	os.Remove(path)
+
+	// left behind by the last run
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("expect the socket for the owner only, but got %v", perm)
+	}
+}
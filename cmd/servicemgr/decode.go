@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tw4452852/servicemgr/capture"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+const decodeUsage = `usage: servicemgr decode [flags] <file>...
+
+Decodes the pcapng files captured by the server, see servicemgr ctl capture,
+to the TLV stream of the frames in order.
+
+flags:
+`
+
+// runDecode runs the decode command with args, and returns the exit code.
+func runDecode(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	peer := fs.String("peer", "", `frames of the peer only, "device" or "client <id>"`)
+	text := fs.Bool("text", false, "print a line per frame instead")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, decodeUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+	for _, name := range fs.Args() {
+		if err := decodeFile(name, *peer, *text, w); err != nil {
+			fmt.Fprintf(stderr, "servicemgr decode: %s: %s\n", name, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func decodeFile(name, peer string, text bool, w io.Writer) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := capture.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	for {
+		frame, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if peer != "" && frame.Peer != peer {
+			continue
+		}
+		if text {
+			_, err = fmt.Fprintf(w, "%s %s %v\n", frame.Time.Format("2006-01-02T15:04:05.000000"), frame.Peer, frame.TLV)
+		} else {
+			err = util.WriteTLV(w, frame.TLV)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/capture"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestDecode(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.pcapng")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := capture.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlvs := []util.TLV{
+		{T: 1, L: 2, V: []byte("hi")},
+		{T: 2, L: 0, V: []byte{}},
+	}
+	w.WriteTLV(capture.DevicePeer, time.Now(), tlvs[0])
+	w.WriteTLV(capture.ClientPeer(3), time.Now(), tlvs[1])
+	f.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := runDecode([]string{name}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expect exit 0, but got %d: %s", code, stderr.String())
+	}
+	for _, expect := range tlvs {
+		tlv, err := util.ReadTLV(&stdout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlv.String() != expect.String() {
+			t.Errorf("expect %v, but got %v", expect, tlv)
+		}
+	}
+
+	stdout.Reset()
+	if code := runDecode([]string{"-text", "-peer", "client 3", name}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expect exit 0, but got %d: %s", code, stderr.String())
+	}
+	if out := stdout.String(); strings.Count(out, "\n") != 1 || !strings.Contains(out, "client 3 [type: 0x2, length: 0") {
+		t.Errorf("unexpected %q", out)
+	}
+
+	if code := runDecode([]string{"decode.go"}, &stdout, &stderr); code != 1 {
+		t.Errorf("expect exit 1 for not a pcapng file, but got %d", code)
+	}
+}
@@ -1,30 +1,32 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+
+	"github.com/tw4452852/servicemgr/logging"
 )
 
-var debug int = 0
+// LogInit makes the default logger write to stderr, in json if asJSON,
+// with the default level. It returns the levels to change at runtime,
+// SIGUSR1 toggles the default level between debug and level.
+func LogInit(level slog.Level, asJSON bool) *logging.Levels {
+	levels := logging.NewLevels(level)
+	slog.SetDefault(logging.New(os.Stderr, asJSON, levels))
 
-func LogInit() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR1)
 	go func() {
-		for {
-			select {
-			case s := <-c:
-				log.Printf("get signal %v, change debug from %d to %d\n", s, debug, debug^1)
-				debug ^= 1
+		for sig := range c {
+			to := slog.LevelDebug
+			if levels.Default() == slog.LevelDebug {
+				to = level
 			}
+			slog.Info("change default log level", "signal", sig, "level", to)
+			levels.SetDefault(to)
 		}
 	}()
-}
-
-func Log(format string, v ...interface{}) {
-	if debug > 0 {
-		log.Printf(format, v...)
-	}
+	return levels
 }
@@ -1,28 +1,69 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/server"
 )
 
 var VERSION string
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:], os.Stdout, os.Stderr))
+		case "decode":
+			os.Exit(runDecode(os.Args[2:], os.Stdout, os.Stderr))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:], os.Stderr))
+		}
+	}
+
 	help := flag.Bool("h", false, "help message")
 	version := flag.Bool("v", false, "version")
 	serverAddr := flag.String("s", ":22222", "server listen address")
 	clientAddr := flag.String("c", ":22223", "client listen address")
 	debugAddr := flag.String("d", ":22224", "debug listen address")
+	authFile := flag.String("a", "", "client authentication config file, empty to disable")
+	tlsCert := flag.String("tls-cert", "", "server listener certificate file, empty to disable TLS")
+	tlsKey := flag.String("tls-key", "", "server listener key file")
+	tlsCA := flag.String("tls-ca", "", "CA file to verify device certificates, empty to disable mutual TLS")
+	clientTLSCert := flag.String("client-tls-cert", "", "client listener certificate file, empty to disable TLS")
+	clientTLSKey := flag.String("client-tls-key", "", "client listener key file")
+	clientTLSCA := flag.String("client-tls-ca", "", "CA file to verify client certificates, empty to disable mutual TLS")
+	pskFile := flag.String("psk", "", "pre-shared key file to authenticate devices, empty to disable")
+	admissionFile := flag.String("acl", "", "acl and admission control config file, empty to disable")
+	groupsFile := flag.String("groups", "", "client groups config file for multicast")
+	pingInterval := flag.Duration("ping-interval", 0, "interval to ping the device and idle clients, 0 to disable")
+	maxMissed := flag.Int("ping-miss", server.DefaultMaxMissed, "close the peer after missing this number of pings in a row")
+	handshakeTimeout := flag.Duration("handshake-timeout", server.DefaultHandshakeTimeout, "close the device not finishing the handshake in time, or keep it without audio if only the audio is late")
+	audioRetry := flag.Duration("audio-retry", server.DefaultAudioRetryInterval, "interval to request audio again after the device refused it")
+	resumeGrace := flag.Duration("resume-grace", server.DefaultResumeGrace, "how long a dropped client could resume its session")
+	shutdownTimeout := flag.Duration("shutdown-timeout", server.DefaultShutdownTimeout, "how long to tell the clients to leave on SIGINT/SIGTERM")
+	logLevel := flag.String("log-level", "info", "default log level: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "write the logs in json")
+	adminTokenFile := flag.String("admin-token", "", "bearer token file of the admin api and pprof on the debug listener, empty to disable them")
+	debugLockdown := flag.Bool("debug-lockdown", false, "put the registry, status, metrics and log levels on the debug listener behind the admin token too, leaving only the probes open")
+	adminSocket := flag.String("admin-socket", "", "unix socket serving the admin api without token, empty to disable")
+	captureDir := flag.String("capture-dir", "", "directory of the captures started by the admin api, empty to disable")
 	flag.Parse()
 
 	if *help {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: servicemgr [flags]\n       servicemgr ctl [flags] <command> [args]\n       servicemgr decode [flags] <file>...\n       servicemgr replay [flags] <file>...\n")
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -32,37 +73,197 @@ func main() {
 		os.Exit(0)
 	}
 
-	log.Printf("serverAddr[%q], clientAddr[%q], debugAddr[%q]\n", *serverAddr, *clientAddr, *debugAddr)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatal(err)
+	}
+	levels := LogInit(level, *logJSON)
+	slog.Info("start", "server", *serverAddr, "client", *clientAddr, "debug", *debugAddr)
+
+	config := server.Config{
+		HandshakeTimeout:   *handshakeTimeout,
+		AudioRetryInterval: *audioRetry,
+		PingInterval:       *pingInterval,
+		MaxMissed:          *maxMissed,
+		ResumeGrace:        *resumeGrace,
+		ShutdownTimeout:    *shutdownTimeout,
+		CaptureDir:         *captureDir,
+	}
+
+	if *pskFile != "" {
+		psk, err := ioutil.ReadFile(*pskFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		psk = bytes.TrimSpace(psk)
+		if len(psk) == 0 {
+			log.Fatalf("psk file %q is empty", *pskFile)
+		}
+		config.PSK = psk
+	}
+
+	if *authFile != "" {
+		auth, err := server.LoadAuth(*authFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Auth = auth
+	}
+
+	var reloaders []server.Reloader
+	serverTLS := loadTLS(*tlsCert, *tlsKey, *tlsCA)
+	if serverTLS != nil {
+		reloaders = append(reloaders, serverTLS)
+	}
+	clientTLS := loadTLS(*clientTLSCert, *clientTLSKey, *clientTLSCA)
+	if clientTLS != nil {
+		reloaders = append(reloaders, clientTLS)
+	}
+
+	srv := server.NewServer(config)
+
+	if *admissionFile != "" {
+		r, err := server.NewFileReloader(*admissionFile, func(data []byte) error {
+			a, err := server.ParseAdmission(data)
+			if err != nil {
+				return err
+			}
+			srv.SetAdmission(a)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, r)
+	}
+
+	if *groupsFile != "" {
+		r, err := server.NewFileReloader(*groupsFile, func(data []byte) error {
+			gs, err := server.ParseGroups(data)
+			if err != nil {
+				return err
+			}
+			srv.SetGroups(gs)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, r)
+	}
+
+	stopReload := ReloadOnSignal(reloaders...)
+	defer func() {
+		stopReload()
+		for _, r := range reloaders {
+			r.Close()
+		}
+	}()
 
-	server, err := NewServer(*serverAddr)
+	deviceLn, err := serverTLS.Listen(*serverAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer server.Close()
-
-	ln, err := net.Listen("tcp", *clientAddr)
+	clientLn, err := clientTLS.Listen(*clientAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var adminToken string
+	if *adminTokenFile != "" {
+		token, err := ioutil.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adminToken = string(bytes.TrimSpace(token))
+		if adminToken == "" {
+			log.Fatalf("admin token file %q is empty", *adminTokenFile)
+		}
+	}
+
 	// for debug
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", srv.ServeHealthz)
+	mux.HandleFunc("/readyz", srv.ServeReadyz)
+	admin := http.NewServeMux()
+	admin.HandleFunc("/registry", srv.ServeRegistry)
+	admin.HandleFunc("/health", srv.ServeHealth)
+	admin.HandleFunc("/status", srv.ServeStatus)
+	admin.HandleFunc("/metrics", srv.ServeMetrics)
+	admin.Handle("/admin/", srv.AdminHandler())
+	admin.Handle("/log", levels)
+	admin.HandleFunc("/debug/pprof/", pprof.Index)
+	admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	open := []string{"/registry", "/health", "/status", "/metrics", "/log"}
+	protected := []string{"/admin/", "/debug/pprof/"}
+	if *debugLockdown {
+		protected, open = append(protected, open...), nil
+	}
+	for _, pattern := range open {
+		mux.Handle(pattern, admin)
+	}
+	for _, pattern := range protected {
+		mux.Handle(pattern, server.RequireToken(adminToken, admin))
+	}
 	go func() {
-		log.Println(http.ListenAndServe(*debugAddr, nil))
+		slog.Error("debug listener exit", "err", http.ListenAndServe(*debugAddr, mux))
 	}()
 
-	// init debug log
-	LogInit()
-
-	for {
-		conn, err := ln.Accept()
+	if *adminSocket != "" {
+		ln, err := listenUnix(*adminSocket)
 		if err != nil {
-			log.Printf("[client]: accept error: %s\n", err)
-			continue
+			log.Fatal(err)
 		}
-		err = server.AddClient(client.NewClient(MakeKeepAlive(conn)))
-		if err != nil {
-			log.Printf("[client]: AddClient error: %s\n", err)
-			continue
+		defer ln.Close()
+		// the socket is guarded by its file mode instead
+		mux := http.NewServeMux()
+		mux.Handle("/", admin)
+		mux.HandleFunc("/healthz", srv.ServeHealthz)
+		mux.HandleFunc("/readyz", srv.ServeReadyz)
+		go func() {
+			if err := http.Serve(ln, mux); !errors.Is(err, net.ErrClosed) {
+				slog.Error("admin socket exit", "err", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := srv.Serve(ctx, deviceLn, clientLn); err != nil {
+		slog.Warn("shutdown", "err", err)
+	}
+	slog.Info("shutdown done")
+}
+
+func loadTLS(cert, key, ca string) *server.CertReloader {
+	if cert == "" {
+		return nil
+	}
+	r, err := server.NewCertReloader(cert, key, ca)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return r
+}
+
+// listenUnix listens on the unix socket path, which is accessible to the
+// owner only.
+func listenUnix(path string) (net.Listener, error) {
+	// left behind by the last run, don't remove anything else
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
 		}
 	}
+	// created with the owner only, no one else could connect in between
+	mask := syscall.Umask(0077)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	return ln, err
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tw4452852/servicemgr/logging"
+	"github.com/tw4452852/servicemgr/server"
+)
+
+// ReloadOnSignal reloads all the rs on SIGHUP, until the returned stop
+// is called.
+func ReloadOnSignal(rs ...server.Reloader) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for s := range c {
+			for _, r := range rs {
+				if err := r.Reload(); err != nil {
+					logging.For(logging.Server).Warn("reload failed", "signal", s, "reloader", r.String(), "err", err)
+					continue
+				}
+				logging.For(logging.Server).Info("reloaded", "signal", s, "reloader", r.String())
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tw4452852/servicemgr/capture"
+	"github.com/tw4452852/servicemgr/replay"
+)
+
+const replayUsage = `usage: servicemgr replay [flags] <file>...
+
+Plays the pcapng files captured by the server, see servicemgr ctl capture,
+as the device of the server. The server mustn't require a psk or TLS from
+the device.
+
+flags:
+`
+
+// runReplay runs the replay command with args, and returns the exit code.
+func runReplay(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("s", "localhost:22222", "server listen address of the devices")
+	speed := fs.Float64("speed", 1, "scale the timing, 2 plays twice as fast")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, replayUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var readers []*capture.Reader
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "servicemgr replay: %s\n", err)
+			return 1
+		}
+		defer f.Close()
+		r, err := capture.NewReader(bufio.NewReader(f))
+		if err != nil {
+			fmt.Fprintf(stderr, "servicemgr replay: %s: %s\n", name, err)
+			return 1
+		}
+		readers = append(readers, r)
+	}
+	rec, err := replay.Load(readers...)
+	if err != nil {
+		fmt.Fprintf(stderr, "servicemgr replay: %s\n", err)
+		return 1
+	}
+	p := replay.NewPlayer(rec, replay.Config{Speed: *speed})
+
+	c, err := net.Dial("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(stderr, "servicemgr replay: %s\n", err)
+		return 1
+	}
+	slog.Info("replay", "server", *addr, "recording", p.String())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err = p.Run(ctx, c); err != nil && err != context.Canceled {
+		fmt.Fprintf(stderr, "servicemgr replay: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,327 @@
+// Package device implements the device end of the link to servicemgr.
+//
+// The device reads the frames of all the clients on a single link, where
+// the high 32 bits of T is the client id (see package server). A Device
+// completes the handshakes, answers the pings and the audio requests of
+// the server, echoes the pings of the clients, and demultiplexes the other
+// frames by client id into sessions:
+//
+//	d, err := device.Dial(ctx, "localhost:22222", device.Config{PSK: psk})
+//	...
+//	for {
+//		s, err := d.Accept(ctx)
+//		if err != nil {
+//			break
+//		}
+//		go serve(s)
+//	}
+package device
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+	// sessionBuffer is the number of frames a session holds before
+	// dropping.
+	sessionBuffer = 256
+)
+
+// ErrClosed is returned after the device is closed.
+var ErrClosed = errors.New("device is closed")
+
+// AudioAnswer is the answer of an audio request of the server.
+type AudioAnswer int
+
+const (
+	AudioAccept AudioAnswer = iota
+	AudioRefuse
+	// AudioIgnore leaves the request unanswered, as a device stuck in the
+	// handshake.
+	AudioIgnore
+)
+
+// Config configures a Device, zero fields take the defaults.
+type Config struct {
+	// TLS is the config to dial the server with TLS, plain if nil.
+	TLS *tls.Config
+	// PSK is the pre-shared key of the server if it requires one.
+	PSK []byte
+	// HandshakeTimeout is how long the handshakes take at most.
+	HandshakeTimeout time.Duration
+	// Audio answers the audio requests of the server, all are accepted
+	// if nil.
+	Audio func(f server.AudioFormat) AudioAnswer
+	// Logger is the default logger if nil.
+	Logger *slog.Logger
+}
+
+func (c *Config) setDefaults() {
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+}
+
+// Device is the device end of a link.
+type Device struct {
+	config Config
+	rwc    io.ReadWriteCloser
+	psk    server.FrameChannel
+	audio  atomic.Bool
+
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	sessions map[uint32]*Session
+	// the sessions not accepted yet
+	pending    []*Session
+	newSession chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// Dial dials the device port of the server at addr.
+func Dial(ctx context.Context, addr string, config Config) (*Device, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.TLS != nil {
+		tc := tls.Client(c, config.TLS)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	return New(c, config)
+}
+
+// Accept accepts a link from ln, for the setups where the device listens.
+func Accept(ln net.Listener, config Config) (*Device, error) {
+	c, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return New(c, config)
+}
+
+// New runs the handshakes on the established link rwc, which is owned by
+// the returned device.
+func New(rwc io.ReadWriteCloser, config Config) (*Device, error) {
+	config.setDefaults()
+	d := &Device{
+		config:     config,
+		rwc:        rwc,
+		sessions:   make(map[uint32]*Session),
+		newSession: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	if len(config.PSK) != 0 {
+		c, ok := rwc.(net.Conn)
+		if ok {
+			c.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+		}
+		psk, err := server.DevicePSKHandshake(rwc, config.PSK)
+		if err != nil {
+			rwc.Close()
+			return nil, err
+		}
+		if ok {
+			c.SetDeadline(time.Time{})
+		}
+		d.psk = psk
+	}
+
+	go d.poll()
+	return d, nil
+}
+
+// AudioEnabled reports whether the audio of the server is accepted.
+func (d *Device) AudioEnabled() bool {
+	return d.audio.Load()
+}
+
+// Done is closed when the link is down, see Err.
+func (d *Device) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns why the link is down.
+func (d *Device) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the link.
+func (d *Device) Close() error {
+	d.shutdown(ErrClosed)
+	return d.rwc.Close()
+}
+
+func (d *Device) shutdown(err error) {
+	d.closeOnce.Do(func() {
+		d.err = err
+		close(d.done)
+	})
+}
+
+// Send writes a frame of type t with value v to address to, a client id
+// or one of the addresses in package server.
+func (d *Device) Send(to uint32, t server.Type, v []byte) error {
+	return d.write(util.TLV{T: uint64(to)<<32 | uint64(t), L: uint64(len(v)), V: v})
+}
+
+// SendScanCode sends the scan code v to address to, 0 for the clients
+// subscribed to TypeScanCode.
+func (d *Device) SendScanCode(to uint32, v []byte) error {
+	return d.Send(to, server.TypeScanCode, v)
+}
+
+func (d *Device) write(tlv util.TLV) error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+	}
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if d.psk != nil {
+		return d.psk.WriteTLV(d.rwc, tlv)
+	}
+	return util.WriteTLV(d.rwc, tlv)
+}
+
+func (d *Device) read() (util.TLV, error) {
+	if d.psk != nil {
+		return d.psk.ReadTLV(d.rwc)
+	}
+	return util.ReadTLV(d.rwc)
+}
+
+// Accept returns the session of the next client sending a frame.
+func (d *Device) Accept(ctx context.Context) (*Session, error) {
+	for {
+		d.mu.Lock()
+		if len(d.pending) > 0 {
+			s := d.pending[0]
+			d.pending = d.pending[1:]
+			d.mu.Unlock()
+			return s, nil
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-d.newSession:
+		case <-d.done:
+			return nil, d.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// poll reads the frames until the link is down.
+func (d *Device) poll() {
+	var err error
+	defer func() {
+		d.rwc.Close()
+		d.shutdown(err)
+	}()
+
+	for {
+		var tlv util.TLV
+		if tlv, err = d.read(); err != nil {
+			return
+		}
+
+		to := uint32(tlv.T >> 32)
+		t := server.Type(tlv.T & 0x00000000ffffffff)
+		switch {
+		case t == server.TypePing:
+			// from the server or a client
+			err = d.write(tlv)
+		case to == server.ServerAddress:
+			// nothing else from the server is for the device
+		case to == 0:
+			err = d.control(t, tlv.V)
+		default:
+			d.session(to).push(Frame{Type: t, Value: tlv.V})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// control handles the unaddressed frame of type t from the server.
+func (d *Device) control(t server.Type, v []byte) error {
+	switch t {
+	case server.TypeOpenSound:
+		var f server.AudioFormat
+		if err := json.Unmarshal(v, &f); err != nil {
+			d.config.Logger.Warn("invalid audio request", "err", err)
+			return d.Send(0, server.ErrorInvalidData, nil)
+		}
+		answer := AudioAccept
+		if d.config.Audio != nil {
+			answer = d.config.Audio(f)
+		}
+		switch answer {
+		case AudioRefuse:
+			d.config.Logger.Info("audio refused", "format", f)
+			return d.Send(0, server.ErrorInvalidData, nil)
+		case AudioIgnore:
+			d.config.Logger.Info("audio request ignored", "format", f)
+			return nil
+		}
+		d.audio.Store(true)
+		return d.Send(0, server.TypeOpenSound, nil)
+	case server.TypeCloseSound:
+		d.audio.Store(false)
+	default:
+		d.config.Logger.Debug("frame from the server skipped", "type", t)
+	}
+	return nil
+}
+
+// session returns the session of client id, which is created if it's new.
+func (d *Device) session(id uint32) *Session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.sessions[id]
+	if !ok {
+		s = &Session{id: id, d: d, frames: make(chan Frame, sessionBuffer), closed: make(chan struct{})}
+		d.sessions[id] = s
+		d.pending = append(d.pending, s)
+		select {
+		case d.newSession <- struct{}{}:
+		default:
+		}
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/server/servertest"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestDevice(t *testing.T) {
+	psk := []byte("secret")
+	srv, deviceAddr, clientAddr := servertest.Start(t, server.Config{
+		PSK:             psk,
+		PingInterval:    10 * time.Millisecond,
+		ShutdownTimeout: 10 * time.Millisecond,
+	})
+
+	ctx := context.Background()
+	if _, err := Dial(ctx, deviceAddr, Config{PSK: []byte("bad"), HandshakeTimeout: time.Second}); err == nil {
+		t.Fatal("expect the handshake failed with a bad psk")
+	}
+	var format server.AudioFormat
+	d, err := Dial(ctx, deviceAddr, Config{PSK: psk, Audio: func(f server.AudioFormat) AudioAnswer {
+		format = f
+		return AudioAccept
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	servertest.WaitState(t, srv, server.StateReady)
+	if !d.AudioEnabled() || format.Rate != MicRate || format.Channel != MicChannel {
+		t.Errorf("expect the audio accepted, but got %v with %+v", d.AudioEnabled(), format)
+	}
+	// answers the pings
+	time.Sleep(50 * time.Millisecond)
+	if h := srv.DeviceStatus().Health; h == nil || h.Missed > 1 {
+		t.Errorf("expect the pings answered, but got %+v", h)
+	}
+
+	c, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = util.WriteTLV(c, util.TLV{T: uint64(server.TypeOpenMic), L: 2, V: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+
+	actx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	s, err := d.Accept(actx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Recv(actx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != server.TypeOpenMic || string(f.Value) != "{}" {
+		t.Errorf("unexpected %+v", f)
+	}
+
+	pcm := make([]byte, 3*MicRate/100*2*MicChannel/2)
+	if err = s.StreamMic(actx, bytes.NewReader(pcm), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SendScanCode([]byte("42")); err != nil {
+		t.Fatal(err)
+	}
+	// the client is pinged as well
+	read := func() (util.TLV, error) {
+		for {
+			tlv, err := util.ReadTLV(c)
+			if err != nil || server.Type(tlv.T) != server.TypePing {
+				return tlv, err
+			}
+		}
+	}
+	got := 0
+	for got < len(pcm) {
+		tlv, err := read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.Type(tlv.T) != server.TypeMicData {
+			t.Fatalf("expect mic data, but got %v", tlv)
+		}
+		got += len(tlv.V)
+	}
+	if tlv, err := read(); err != nil || server.Type(tlv.T) != server.TypeScanCode || string(tlv.V) != "42" {
+		t.Errorf("expect the scan code, but got %v, %v", tlv, err)
+	}
+
+	// forgotten, the next frame starts a new session
+	s.Close()
+	if _, err = s.Recv(actx); err != ErrClosed {
+		t.Errorf("expect %v, but got %v", ErrClosed, err)
+	}
+	util.WriteTLV(c, util.TLV{T: uint64(server.TypeCloseMic)})
+	if s2, err := d.Accept(actx); err != nil || s2 == s || s2.Id() != s.Id() {
+		t.Errorf("expect a new session of %d, but got %v, %v", s.Id(), s2, err)
+	}
+
+	d.Close()
+	if _, err = d.Accept(actx); err != ErrClosed {
+		t.Errorf("expect %v, but got %v", ErrClosed, err)
+	}
+	if err = d.SendScanCode(0, nil); err != ErrClosed {
+		t.Errorf("expect %v, but got %v", ErrClosed, err)
+	}
+}
+
+func TestClosePending(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	d, err := New(c2, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	s := d.session(5)
+	s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if s, err := d.Accept(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expect the closed session never accepted, but got %v, %v", s, err)
+	}
+}
+
+func TestRefuseAudio(t *testing.T) {
+	for _, answer := range []AudioAnswer{AudioRefuse, AudioIgnore} {
+		srv, deviceAddr, _ := servertest.Start(t, server.Config{HandshakeTimeout: 50 * time.Millisecond, ShutdownTimeout: 10 * time.Millisecond})
+		d, err := Dial(context.Background(), deviceAddr, Config{Audio: func(server.AudioFormat) AudioAnswer { return answer }})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		servertest.WaitState(t, srv, server.StateReadyNoAudio)
+		if d.AudioEnabled() {
+			t.Errorf("%d: expect the audio refused", answer)
+		}
+	}
+}
+
+func TestParseFileTransfer(t *testing.T) {
+	for v, expect := range map[string]FileTransfer{
+		`{"name":"a.txt","data":"aGVsbG8="}`: {Name: "a.txt", Data: []byte("hello")},
+		`{"data":"aGVsbG8="}`:                {Data: []byte(`{"data":"aGVsbG8="}`)},
+		"raw":                                {Data: []byte("raw")},
+	} {
+		if f := ParseFileTransfer([]byte(v)); f.Name != expect.Name || !bytes.Equal(f.Data, expect.Data) {
+			t.Errorf("%s: expect %+v, but got %+v", v, expect, f)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/tw4452852/servicemgr/server"
+)
+
+// The format of the mic, the same as the sound requested by the server.
+const (
+	MicRate    = 44100
+	MicChannel = 2
+	// MicInterval is the interval of the mic frames by default.
+	MicInterval = 20 * time.Millisecond
+)
+
+// Frame is a frame from a client.
+type Frame struct {
+	Type  server.Type
+	Value []byte
+}
+
+// FileTransfer is the value of TypeFileTransfer carrying a named file,
+// the server forwards it as it is.
+type FileTransfer struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// ParseFileTransfer parses the value of TypeFileTransfer. A value that
+// isn't a FileTransfer is the file itself without a name.
+func ParseFileTransfer(v []byte) FileTransfer {
+	var f FileTransfer
+	if json.Unmarshal(v, &f) != nil || f.Name == "" {
+		return FileTransfer{Data: v}
+	}
+	return f
+}
+
+// Session is the frames of a client on the link.
+type Session struct {
+	id     uint32
+	d      *Device
+	frames chan Frame
+	// closed when the session is forgotten by Close
+	closed chan struct{}
+}
+
+// Id returns the client id.
+func (s *Session) Id() uint32 {
+	return s.id
+}
+
+// push passes f to the session, it's dropped if the session is full.
+func (s *Session) push(f Frame) {
+	select {
+	case s.frames <- f:
+	default:
+		s.d.config.Logger.Warn("session is full, drop the frame", "client", s.id, "type", f.Type)
+	}
+}
+
+// Recv returns the next frame of the client.
+func (s *Session) Recv(ctx context.Context) (Frame, error) {
+	select {
+	case f := <-s.frames:
+		return f, nil
+	case <-s.closed:
+		return Frame{}, ErrClosed
+	case <-s.d.done:
+		return Frame{}, s.d.err
+	case <-ctx.Done():
+		return Frame{}, ctx.Err()
+	}
+}
+
+// Close forgets the session, the next frame of the client starts a new
+// one. It's never accepted if it isn't yet.
+func (s *Session) Close() {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.d.sessions[s.id] == s {
+		delete(s.d.sessions, s.id)
+		close(s.closed)
+	}
+	for i, p := range s.d.pending {
+		if p == s {
+			s.d.pending = append(s.d.pending[:i:i], s.d.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// Reply sends a frame of type t with value v to the client.
+func (s *Session) Reply(t server.Type, v []byte) error {
+	return s.d.Send(s.id, t, v)
+}
+
+// ReplyError sends the error type t, e.g. server.ErrorInvalidData, to the
+// client.
+func (s *Session) ReplyError(t server.Type) error {
+	return s.d.Send(s.id, t, nil)
+}
+
+// SendScanCode sends the scan code v to the client.
+func (s *Session) SendScanCode(v []byte) error {
+	return s.d.Send(s.id, server.TypeScanCode, v)
+}
+
+// StreamMic streams the 16 bit pcm read from r in the mic format to the
+// client every interval (MicInterval if zero), until r ends or ctx is done.
+func (s *Session) StreamMic(ctx context.Context, r io.Reader, interval time.Duration) error {
+	if interval <= 0 {
+		interval = MicInterval
+	}
+	size := int(int64(MicRate)*int64(interval)/int64(time.Second)) * 2 * MicChannel
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pcm := make([]byte, size)
+		n, err := io.ReadFull(r, pcm)
+		if n > 0 {
+			if err := s.d.Send(s.id, server.TypeMicData, pcm[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.d.done:
+			return s.d.err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// snapshot is the json form of the levels.
+type snapshot struct {
+	Default    slog.Level            `json:"default"`
+	Subsystems map[string]slog.Level `json:"subsystems"`
+	Clients    map[uint32]slog.Level `json:"clients"`
+}
+
+func (l *Levels) snapshot() snapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	s := snapshot{
+		Default:    l.def,
+		Subsystems: make(map[string]slog.Level, len(l.subsystems)),
+		Clients:    make(map[uint32]slog.Level, len(l.clients)),
+	}
+	for k, v := range l.subsystems {
+		s.Subsystems[k] = v
+	}
+	for k, v := range l.clients {
+		s.Clients[k] = v
+	}
+	return s
+}
+
+// ServeHTTP serves the levels as json on GET, and changes them on POST or
+// PUT with the query:
+//
+//	level=debug                  sets the default level
+//	subsystem=tlv&level=debug    sets the level of the subsystem
+//	client=1000&level=debug      sets the level of the client
+//
+// level=reset drops the level of the subsystem or the client.
+func (l *Levels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if err := l.set(r.FormValue("subsystem"), r.FormValue("client"), r.FormValue("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.snapshot())
+}
+
+func (l *Levels) set(subsystem, client, value string) error {
+	if subsystem != "" && client != "" {
+		return fmt.Errorf("either subsystem or client")
+	}
+	var id uint32
+	if client != "" {
+		v, err := strconv.ParseUint(client, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid client %q", client)
+		}
+		id = uint32(v)
+	}
+
+	if value == "reset" {
+		switch {
+		case subsystem != "":
+			l.ResetSubsystem(subsystem)
+		case client != "":
+			l.ResetClient(id)
+		default:
+			return fmt.Errorf("no default level to reset")
+		}
+		return nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return fmt.Errorf("invalid level %q", value)
+	}
+	switch {
+	case subsystem != "":
+		l.SetSubsystem(subsystem, level)
+	case client != "":
+		l.SetClient(id, level)
+	default:
+		l.SetDefault(level)
+	}
+	return nil
+}
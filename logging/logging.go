@@ -0,0 +1,213 @@
+// Package logging provides structured logs whose levels could be changed
+// per subsystem and per client at runtime.
+//
+// Each log carries the subsystem it comes from (see SubsystemKey) and
+// optionally the client it's about (see ClientKey). The level of a log is
+// checked against the level of its client if there is one, or the level of
+// its subsystem if there is one, or the default level at last.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// The attributes the levels apply to.
+const (
+	SubsystemKey = "subsystem"
+	ClientKey    = "client"
+)
+
+// The subsystems.
+const (
+	TLV        = "tlv"
+	Server     = "server"
+	Connection = "connection"
+	Audio      = "audio"
+	Client     = "client"
+)
+
+// Levels are the levels of the subsystems and the clients.
+type Levels struct {
+	mu         sync.RWMutex
+	def        slog.Level
+	subsystems map[string]slog.Level
+	clients    map[uint32]slog.Level
+}
+
+// NewLevels creates levels with the default level def.
+func NewLevels(def slog.Level) *Levels {
+	return &Levels{
+		def:        def,
+		subsystems: make(map[string]slog.Level),
+		clients:    make(map[uint32]slog.Level),
+	}
+}
+
+// Default returns the level of the logs without any other level.
+func (l *Levels) Default() slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.def
+}
+
+func (l *Levels) SetDefault(level slog.Level) {
+	l.mu.Lock()
+	l.def = level
+	l.mu.Unlock()
+}
+
+// SetSubsystem sets the level of subsystem.
+func (l *Levels) SetSubsystem(subsystem string, level slog.Level) {
+	l.mu.Lock()
+	l.subsystems[subsystem] = level
+	l.mu.Unlock()
+}
+
+// ResetSubsystem makes subsystem take the default level.
+func (l *Levels) ResetSubsystem(subsystem string) {
+	l.mu.Lock()
+	delete(l.subsystems, subsystem)
+	l.mu.Unlock()
+}
+
+// SetClient sets the level of client id.
+func (l *Levels) SetClient(id uint32, level slog.Level) {
+	l.mu.Lock()
+	l.clients[id] = level
+	l.mu.Unlock()
+}
+
+// ResetClient makes client id take the level of the subsystem.
+func (l *Levels) ResetClient(id uint32) {
+	l.mu.Lock()
+	delete(l.clients, id)
+	l.mu.Unlock()
+}
+
+// level returns the level of the logs of subsystem about client id (if
+// hasClient).
+func (l *Levels) level(subsystem string, id uint32, hasClient bool) slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if hasClient {
+		if level, ok := l.clients[id]; ok {
+			return level
+		}
+	}
+	if level, ok := l.subsystems[subsystem]; ok {
+		return level
+	}
+	return l.def
+}
+
+// minClient returns the lowest level of the clients, ok is false if none.
+func (l *Levels) minClient() (min slog.Level, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, level := range l.clients {
+		if !ok || level < min {
+			min, ok = level, true
+		}
+	}
+	return
+}
+
+// Handler filters the logs by the levels, then passes them to the
+// underlying handler.
+type Handler struct {
+	levels *Levels
+	next   slog.Handler
+
+	subsystem string
+	client    uint32
+	hasClient bool
+	// the attributes added afterwards are in a group
+	grouped bool
+}
+
+// NewHandler creates a handler passing the logs enabled by levels to next.
+func NewHandler(next slog.Handler, levels *Levels) *Handler {
+	return &Handler{levels: levels, next: next}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= h.levels.level(h.subsystem, h.client, h.hasClient) {
+		return true
+	}
+	// the client may be known only in Handle
+	if !h.hasClient {
+		if min, ok := h.levels.minClient(); ok && level >= min {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	subsystem, id, hasClient := h.subsystem, h.client, h.hasClient
+	r.Attrs(func(a slog.Attr) bool {
+		subsystem, id, hasClient = h.pick(a, subsystem, id, hasClient)
+		return true
+	})
+	if r.Level < h.levels.level(subsystem, id, hasClient) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	for _, a := range attrs {
+		h2.subsystem, h2.client, h2.hasClient = h.pick(a, h2.subsystem, h2.client, h2.hasClient)
+	}
+	h2.next = h.next.WithAttrs(attrs)
+	return &h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.grouped = true
+	h2.next = h.next.WithGroup(name)
+	return &h2
+}
+
+// pick updates the subsystem and the client with a.
+func (h *Handler) pick(a slog.Attr, subsystem string, id uint32, hasClient bool) (string, uint32, bool) {
+	if h.grouped {
+		return subsystem, id, hasClient
+	}
+	switch a.Key {
+	case SubsystemKey:
+		subsystem = a.Value.String()
+	case ClientKey:
+		if v, err := strconv.ParseUint(a.Value.String(), 10, 32); err == nil {
+			id, hasClient = uint32(v), true
+		}
+	}
+	return subsystem, id, hasClient
+}
+
+// New creates a logger writing to w in text, or in json if asJSON.
+func New(w io.Writer, asJSON bool, levels *Levels) *slog.Logger {
+	// filtered by the levels only
+	opts := &slog.HandlerOptions{Level: slog.Level(-1 << 31)}
+	var next slog.Handler
+	if asJSON {
+		next = slog.NewJSONHandler(w, opts)
+	} else {
+		next = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(NewHandler(next, levels))
+}
+
+// For returns the default logger of subsystem, it's looked up each time
+// so the default logger could be replaced afterwards.
+func For(subsystem string) *slog.Logger {
+	return slog.Default().With(SubsystemKey, subsystem)
+}
@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var b bytes.Buffer
+	levels := NewLevels(slog.LevelInfo)
+	l := New(&b, false, levels)
+	server := l.With(SubsystemKey, Server)
+	client := l.With(SubsystemKey, Client)
+
+	cases := []struct {
+		name   string
+		setup  func()
+		log    func()
+		expect bool
+	}{
+		{"default", func() {}, func() { server.Info("hello") }, true},
+		{"below default", func() {}, func() { server.Debug("hello") }, false},
+		{
+			"subsystem",
+			func() { levels.SetSubsystem(Client, slog.LevelDebug) },
+			func() { client.Debug("hello", ClientKey, 1) },
+			true,
+		},
+		{"other subsystem", func() {}, func() { server.Debug("hello") }, false},
+		{
+			"reset subsystem",
+			func() { levels.ResetSubsystem(Client) },
+			func() { client.Debug("hello", ClientKey, 1) },
+			false,
+		},
+		{
+			"client",
+			func() { levels.SetClient(2, slog.LevelDebug) },
+			func() { client.Debug("hello", ClientKey, uint32(2)) },
+			true,
+		},
+		{"bound client", func() {}, func() { client.With(ClientKey, 2).Debug("hello") }, true},
+		{"other client", func() {}, func() { client.Debug("hello", ClientKey, 1) }, false},
+		{
+			"client over subsystem",
+			func() { levels.SetSubsystem(Client, slog.LevelDebug); levels.SetClient(1, slog.LevelError) },
+			func() { client.Warn("hello", ClientKey, 1) },
+			false,
+		},
+		{"grouped client", func() {}, func() { server.WithGroup("g").Debug("hello", ClientKey, 2) }, false},
+	}
+	for _, c := range cases {
+		b.Reset()
+		c.setup()
+		c.log()
+		if got := b.Len() > 0; got != c.expect {
+			t.Errorf("%s: expect logged %v, but got %q", c.name, c.expect, b.String())
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, true, NewLevels(slog.LevelInfo))
+	l.With(SubsystemKey, TLV).Info("hello", ClientKey, 1)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("invalid json %q: %s", b.String(), err)
+	}
+	if got["msg"] != "hello" || got[SubsystemKey] != TLV || got[ClientKey] != 1.0 {
+		t.Errorf("unexpected %v", got)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	levels := NewLevels(slog.LevelInfo)
+	for _, c := range []struct {
+		query string
+		code  int
+	}{
+		{"level=debug", 200},
+		{"subsystem=tlv&level=warn", 200},
+		{"client=1000&level=debug", 200},
+		{"client=1001&level=error", 200},
+		{"client=1001&level=reset", 200},
+		{"level=reset", 400},
+		{"level=verbose", 400},
+		{"client=x&level=debug", 400},
+		{"subsystem=tlv&client=1&level=debug", 400},
+	} {
+		w := httptest.NewRecorder()
+		levels.ServeHTTP(w, httptest.NewRequest("PUT", "/log?"+c.query, nil))
+		if w.Code != c.code {
+			t.Errorf("%s: expect %d, but got %d: %s", c.query, c.code, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	levels.ServeHTTP(w, httptest.NewRequest("GET", "/log", nil))
+	expect := `{"default":"DEBUG","subsystems":{"tlv":"WARN"},"clients":{"1000":"DEBUG"}}`
+	if got := strings.TrimSpace(w.Body.String()); got != expect {
+		t.Errorf("expect %s, but got %s", expect, got)
+	}
+
+	w = httptest.NewRecorder()
+	levels.ServeHTTP(w, httptest.NewRequest("DELETE", "/log", nil))
+	if w.Code != 405 {
+		t.Errorf("expect 405, but got %d", w.Code)
+	}
+}
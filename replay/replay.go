@@ -0,0 +1,330 @@
+// Package replay plays a recorded session as the device, so the clients
+// could be tested against a real server without the hardware.
+//
+// A recording is the frames read by the server from the device and the
+// clients, e.g. captured by the server (see package capture). The player
+// plays them back in two ways:
+//
+//   - The device frames addressed to a client after a request of it (a
+//     frame forwarded to the device) are the replies to the request. They
+//     are sent when a live client sends a matching request, to that client
+//     and with the same delays since the request.
+//   - The other device frames are sent on the timeline since the start.
+//
+// A request matches a recorded one of the same type, the one with the
+// same value first. Once matched, the device frames to the recorded client
+// go to the live one. The player also answers the pings and the audio
+// requests of the server by itself.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/tw4452852/servicemgr/capture"
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+var badPeerErr = errors.New("unknown peer")
+
+// Frame is a frame of a recording.
+type Frame struct {
+	// Offset is the time since the start of the recording.
+	Offset time.Duration
+	// FromDevice tells the direction, Client is the client a frame is
+	// read from otherwise.
+	FromDevice bool
+	Client     uint32
+	// TLV is the frame as read, the device ones are addressed with the
+	// high 32 bits of T.
+	TLV util.TLV
+}
+
+// Recording is a recorded session.
+type Recording struct {
+	Frames []Frame
+}
+
+// Load reads a recording from the captures read in order, e.g. the
+// rotated files of a capture.
+func Load(readers ...*capture.Reader) (*Recording, error) {
+	rec := &Recording{}
+	var start time.Time
+	for _, r := range readers {
+		for {
+			f, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			frame := Frame{TLV: f.TLV}
+			if f.Peer == capture.DevicePeer {
+				frame.FromDevice = true
+			} else if _, err = fmt.Sscanf(f.Peer, "client %d", &frame.Client); err != nil {
+				return nil, fmt.Errorf("%w %q", badPeerErr, f.Peer)
+			}
+			if start.IsZero() {
+				start = f.Time
+			}
+			frame.Offset = f.Time.Sub(start)
+			rec.Frames = append(rec.Frames, frame)
+		}
+	}
+	return rec, nil
+}
+
+// local are the types of the frames from the clients handled by the server
+// itself, which never reach the device.
+var local = map[server.Type]bool{
+	server.TypePing:        true,
+	server.TypeAuth:        true,
+	server.TypeHandshake:   true,
+	server.TypeRegister:    true,
+	server.TypeResume:      true,
+	server.TypeSubscribe:   true,
+	server.TypeUnsubscribe: true,
+	server.TypeMessage:     true,
+	server.TypeStatus:      true,
+}
+
+// isClient reports whether address id is a client.
+func isClient(id uint32) bool {
+	return id != 0 && id < server.GroupAddress(0)
+}
+
+// reply is a device frame replied after a delay since the request.
+type reply struct {
+	delay time.Duration
+	tlv   util.TLV
+}
+
+// trigger is a recorded request with its replies.
+type trigger struct {
+	client  uint32
+	typ     server.Type
+	value   []byte
+	replies []reply
+	used    bool
+}
+
+// Config configures a Player, zero fields take the defaults.
+type Config struct {
+	// Speed scales the timing, 2 plays twice as fast. It's 1 to preserve
+	// the timing by default.
+	Speed float64
+	// Logger is the default logger if nil.
+	Logger *slog.Logger
+}
+
+// Player plays a recording as the device.
+type Player struct {
+	config   Config
+	timeline []Frame
+	triggers []*trigger
+
+	mu sync.Mutex
+	// the live clients of the recorded ones
+	clients map[uint32]uint32
+}
+
+// NewPlayer compiles rec into a player.
+func NewPlayer(rec *Recording, config Config) *Player {
+	if config.Speed <= 0 {
+		config.Speed = 1
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	p := &Player{config: config}
+
+	// the last request of the recorded clients
+	last := make(map[uint32]*trigger)
+	lastAt := make(map[uint32]time.Duration)
+	for _, f := range rec.Frames {
+		typ := server.Type(f.TLV.T & 0x00000000ffffffff)
+		if !f.FromDevice {
+			if local[typ] {
+				continue
+			}
+			t := &trigger{client: f.Client, typ: typ, value: f.TLV.V}
+			p.triggers = append(p.triggers, t)
+			last[f.Client], lastAt[f.Client] = t, f.Offset
+			continue
+		}
+
+		to := uint32(f.TLV.T >> 32)
+		if to == server.ServerAddress {
+			// answered by the player itself
+			continue
+		}
+		if t := last[to]; t != nil {
+			t.replies = append(t.replies, reply{delay: f.Offset - lastAt[to], tlv: f.TLV})
+			continue
+		}
+		p.timeline = append(p.timeline, f)
+	}
+	return p
+}
+
+// Run plays on the device link rwc until ctx is done or the link fails,
+// rwc is closed when it returns. The link should be a plain one, without
+// the psk of the server.
+func (p *Player) Run(ctx context.Context, rwc io.ReadWriteCloser) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		rwc.Close()
+	}()
+
+	var wmu sync.Mutex
+	write := func(tlv util.TLV) {
+		wmu.Lock()
+		err := util.WriteTLV(rwc, tlv)
+		wmu.Unlock()
+		if err != nil {
+			p.config.Logger.Warn("replay write failed", "tlv", tlv, "err", err)
+		}
+	}
+
+	start := time.Now()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, f := range p.timeline {
+			if !p.sleep(ctx, start, f.Offset) {
+				return
+			}
+			tlv, ok := p.address(f.TLV)
+			if !ok {
+				p.config.Logger.Debug("replay skip the frame to an unknown client", "tlv", f.TLV)
+				continue
+			}
+			write(tlv)
+		}
+		p.config.Logger.Info("replay timeline done", "frames", len(p.timeline))
+	}()
+
+	for {
+		tlv, err := util.ReadTLV(rwc)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		from := uint32(tlv.T >> 32)
+		typ := server.Type(tlv.T & 0x00000000ffffffff)
+		switch {
+		case from == server.ServerAddress && typ == server.TypePing:
+			write(tlv)
+		case from == 0 && typ == server.TypeOpenSound:
+			write(util.TLV{T: uint64(server.TypeOpenSound), L: 0, V: []byte{}})
+		case isClient(from):
+			t := p.match(from, typ, tlv.V)
+			if t == nil {
+				p.config.Logger.Info("replay no recorded request", "client", from, "type", typ)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				at := time.Now()
+				for _, r := range t.replies {
+					if !p.sleep(ctx, at, r.delay) {
+						return
+					}
+					write(util.TLV{T: uint64(from)<<32 | r.tlv.T&0x00000000ffffffff, L: r.tlv.L, V: r.tlv.V})
+				}
+			}()
+		}
+	}
+}
+
+// sleep sleeps until offset scaled since start, and reports whether ctx is
+// still alive.
+func (p *Player) sleep(ctx context.Context, start time.Time, offset time.Duration) bool {
+	d := time.Until(start.Add(time.Duration(float64(offset) / p.config.Speed)))
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// match returns the recorded request matching the one of the live client,
+// and binds the recorded client to it.
+func (p *Player) match(client uint32, typ server.Type, value []byte) *trigger {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var found *trigger
+	for _, pass := range []func(t *trigger) bool{
+		func(t *trigger) bool { return !t.used && bytes.Equal(t.value, value) },
+		func(t *trigger) bool { return !t.used },
+		func(t *trigger) bool { return bytes.Equal(t.value, value) },
+	} {
+		for _, t := range p.triggers {
+			if t.typ == typ && pass(t) {
+				found = t
+				break
+			}
+		}
+		if found != nil {
+			break
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	found.used = true
+	if p.clients == nil {
+		p.clients = make(map[uint32]uint32)
+	}
+	p.clients[found.client] = client
+	return found
+}
+
+// address addresses tlv of the timeline to the live client of the recorded
+// one, and reports false if there is none.
+func (p *Player) address(tlv util.TLV) (util.TLV, bool) {
+	to := uint32(tlv.T >> 32)
+	if !isClient(to) {
+		return tlv, true
+	}
+	p.mu.Lock()
+	live, ok := p.clients[to]
+	p.mu.Unlock()
+	if !ok {
+		return tlv, false
+	}
+	tlv.T = uint64(live)<<32 | tlv.T&0x00000000ffffffff
+	return tlv, true
+}
+
+// String summarizes the player.
+func (p *Player) String() string {
+	n := 0
+	for _, t := range p.triggers {
+		n += len(t.replies)
+	}
+	return fmt.Sprintf("%d frames on the timeline, %d requests with %d replies", len(p.timeline), len(p.triggers), n)
+}
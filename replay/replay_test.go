@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/capture"
+	"github.com/tw4452852/servicemgr/server"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func tlv(to uint32, t server.Type, v string) util.TLV {
+	return util.TLV{T: uint64(to)<<32 | uint64(t), L: uint64(len(v)), V: []byte(v)}
+}
+
+func TestLoad(t *testing.T) {
+	var b bytes.Buffer
+	w, err := capture.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	w.WriteTLV(capture.ClientPeer(7), start, tlv(0, server.TypeOpenMic, ""))
+	w.WriteTLV(capture.DevicePeer, start.Add(time.Second), tlv(7, server.TypeMicData, "pcm"))
+	r, err := capture.NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Frames) != 2 {
+		t.Fatalf("expect 2 frames, but got %+v", rec.Frames)
+	}
+	if f := rec.Frames[0]; f.Offset != 0 || f.FromDevice || f.Client != 7 {
+		t.Errorf("unexpected %+v", f)
+	}
+	if f := rec.Frames[1]; f.Offset != time.Second || !f.FromDevice || string(f.TLV.V) != "pcm" {
+		t.Errorf("unexpected %+v", f)
+	}
+}
+
+func TestPlayer(t *testing.T) {
+	rec := &Recording{Frames: []Frame{
+		{Offset: 0, FromDevice: true, TLV: tlv(0, server.TypeScanCode, "boot")},
+		{Offset: 10 * time.Millisecond, Client: 7, TLV: tlv(0, server.TypeRegister, `{"name":"a"}`)},
+		{Offset: 20 * time.Millisecond, Client: 7, TLV: tlv(0, server.TypeOpenMic, "")},
+		{Offset: 30 * time.Millisecond, FromDevice: true, TLV: tlv(7, server.TypeOpenMic, "")},
+		{Offset: 40 * time.Millisecond, FromDevice: true, TLV: tlv(7, server.TypeMicData, "pcm")},
+		{Offset: 50 * time.Millisecond, FromDevice: true, TLV: tlv(server.ServerAddress, server.TypePing, "pong")},
+		{Offset: 60 * time.Millisecond, Client: 7, TLV: tlv(0, server.TypeCloseMic, "")},
+		{Offset: 70 * time.Millisecond, FromDevice: true, TLV: tlv(7, server.TypeCloseMic, "")},
+		{Offset: 500 * time.Millisecond, FromDevice: true, TLV: tlv(server.BroadcastAddress, server.TypeScanCode, "late")},
+	}}
+	p := NewPlayer(rec, Config{Speed: 10})
+	if s := p.String(); s != "2 frames on the timeline, 2 requests with 3 replies" {
+		t.Errorf("unexpected %s", s)
+	}
+
+	serverEnd, deviceEnd := net.Pipe()
+	defer serverEnd.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx, deviceEnd) }()
+
+	read := func() util.TLV {
+		t.Helper()
+		serverEnd.SetReadDeadline(time.Now().Add(time.Second))
+		v, err := util.ReadTLV(serverEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	write := func(v util.TLV) {
+		t.Helper()
+		if err := util.WriteTLV(serverEnd, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v := read(); v.T != uint64(server.TypeScanCode) || string(v.V) != "boot" {
+		t.Errorf("expect the boot frame, but got %v", v)
+	}
+	write(tlv(server.ServerAddress, server.TypePing, `{"heartbeat":1}`))
+	if v := read(); v.T != uint64(server.ServerAddress)<<32|uint64(server.TypePing) {
+		t.Errorf("expect the ping echoed, but got %v", v)
+	}
+	write(tlv(0, server.TypeOpenSound, `{}`))
+	if v := read(); v.T != uint64(server.TypeOpenSound) {
+		t.Errorf("expect the audio accepted, but got %v", v)
+	}
+
+	// the live client 42 plays the recorded 7
+	start := time.Now()
+	write(tlv(42, server.TypeOpenMic, ""))
+	for _, expect := range []util.TLV{tlv(42, server.TypeOpenMic, ""), tlv(42, server.TypeMicData, "pcm")} {
+		if v := read(); v.T != expect.T || !bytes.Equal(v.V, expect.V) {
+			t.Errorf("expect %v, but got %v", expect, v)
+		}
+	}
+	if d := time.Since(start); d < 2*time.Millisecond {
+		t.Errorf("expect the replies scaled to 2ms at least, but got %s", d)
+	}
+	write(tlv(42, server.TypeFileTransfer, ""))
+	write(tlv(42, server.TypeCloseMic, ""))
+	if v := read(); v.T != tlv(42, server.TypeCloseMic, "").T {
+		t.Errorf("expect the mic closed, but got %v", v)
+	}
+	if v := read(); v.T != tlv(server.BroadcastAddress, server.TypeScanCode, "").T || string(v.V) != "late" {
+		t.Errorf("expect the late broadcast, but got %v", v)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expect %v, but got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait the player timeout")
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// ACL is a list of CIDRs allowed or denied to connect.
+// Deny takes precedence, and an empty Allow allows everyone.
+type ACL struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow, deny []*net.IPNet
+}
+
+func parseCIDRs(ss []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		// a single address
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (acl *ACL) parse() (err error) {
+	if acl.allow, err = parseCIDRs(acl.Allow); err != nil {
+		return
+	}
+	acl.deny, err = parseCIDRs(acl.Deny)
+	return
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permit reports whether ip is allowed to connect.
+func (acl *ACL) Permit(ip net.IP) bool {
+	if containsIP(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsIP(acl.allow, ip)
+}
+
+// Admission is the admission control config, loaded from a json file like:
+//
+//	{
+//		"server": {"allow": ["192.168.1.0/24"]},
+//		"client": {"deny": ["10.1.0.0/16", "10.2.0.1"]},
+//		"maxClients": 100,
+//		"maxClientsPerIP": 4
+//	}
+//
+// Zero limits mean unlimited.
+type Admission struct {
+	Server          ACL `json:"server"`
+	Client          ACL `json:"client"`
+	MaxClients      int `json:"maxClients"`
+	MaxClientsPerIP int `json:"maxClientsPerIP"`
+}
+
+func ParseAdmission(data []byte) (*Admission, error) {
+	a := &Admission{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	if err := a.Server.parse(); err != nil {
+		return nil, fmt.Errorf("server acl: %s", err)
+	}
+	if err := a.Client.parse(); err != nil {
+		return nil, fmt.Errorf("client acl: %s", err)
+	}
+	if a.MaxClients < 0 || a.MaxClientsPerIP < 0 {
+		return nil, errors.New("limits should not be negative")
+	}
+	return a, nil
+}
+
+func LoadAdmission(path string) (*Admission, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAdmission(data)
+}
+
+// remoteIP returns the remote ip of a network connection, or nil if
+// v isn't one (e.g. a pipe).
+func remoteIP(v interface{}) net.IP {
+	c, ok := v.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return nil
+	}
+	switch addr := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
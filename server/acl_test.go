@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestACL(t *testing.T) {
+	a, err := ParseAdmission([]byte(`{
+		"server": {"allow": ["192.168.1.0/24"], "deny": ["192.168.1.1"]},
+		"client": {"deny": ["10.1.0.0/16", "fd00::/8"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]struct {
+		acl    *ACL
+		ip     string
+		expect bool
+	}{
+		"serverAllowed":    {acl: &a.Server, ip: "192.168.1.2", expect: true},
+		"serverDenied":     {acl: &a.Server, ip: "192.168.1.1", expect: false},
+		"serverNotAllowed": {acl: &a.Server, ip: "192.168.2.1", expect: false},
+		"clientAllowed":    {acl: &a.Client, ip: "10.2.0.1", expect: true},
+		"clientDenied":     {acl: &a.Client, ip: "10.1.2.3", expect: false},
+		"clientDeniedV6":   {acl: &a.Client, ip: "fd00::1", expect: false},
+	} {
+		if got := c.acl.Permit(net.ParseIP(c.ip)); got != c.expect {
+			t.Errorf("%s: expect %v for %s, but got %v", name, c.expect, c.ip, got)
+		}
+	}
+
+	for _, data := range []string{
+		`{"client": {"allow": ["10.0.0.0/33"]}}`,
+		`{"server": {"deny": ["not an ip"]}}`,
+		`{"maxClients": -1}`,
+	} {
+		if _, err := ParseAdmission([]byte(data)); err == nil {
+			t.Errorf("expect error for %s", data)
+		}
+	}
+}
+
+// tcpClient returns both ends of a loopback tcp connection.
+func tcpClient(t *testing.T) (local, remote net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	local, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestAdmission(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	a, err := ParseAdmission([]byte(`{"maxClients": 2, "maxClientsPerIP": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAdmission(a)
+
+	local, remote := tcpClient(t)
+	defer local.Close()
+	if err = s.AddClient(client.NewClient(remote)); err != nil {
+		t.Fatal(err)
+	}
+
+	// one more from the same ip
+	local2, remote2 := tcpClient(t)
+	defer local2.Close()
+	if err = s.AddClient(client.NewClient(remote2)); err != tooManyClientsErr {
+		t.Fatalf("expect %v, but got %v", tooManyClientsErr, err)
+	}
+	got, err := util.ReadTLV(local2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := util.TLV{T: uint64(ErrorTooManyClients), V: []byte{}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	// one more without an ip
+	clientEnd, err := createClientEnd(s, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+
+	// reach the global limit
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	if err = s.AddClient(client.NewClient(c2)); err != tooManyClientsErr {
+		t.Fatalf("expect %v, but got %v", tooManyClientsErr, err)
+	}
+
+	// config applies without restarting
+	a, err = ParseAdmission([]byte(`{"client": {"deny": ["127.0.0.0/8"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAdmission(a)
+	local3, remote3 := tcpClient(t)
+	defer local3.Close()
+	if err = s.AddClient(client.NewClient(remote3)); err != aclDeniedErr {
+		t.Fatalf("expect %v, but got %v", aclDeniedErr, err)
+	}
+}
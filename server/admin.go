@@ -0,0 +1,374 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// maxSendSize is the max value size of a frame sent by the admin.
+const maxSendSize = 1 << 20
+
+var (
+	noSuchClientErr = errors.New("no such client")
+	noConnectionErr = errors.New("no device connection")
+)
+
+// clientInfo is what the server tracks of a connected client.
+type clientInfo struct {
+	remote      string
+	connectedAt time.Time
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	lastType    atomic.Uint32
+	// disconnected by the admin, its session isn't kept
+	kicked atomic.Bool
+}
+
+func newClientInfo(c *client.Client) *clientInfo {
+	info := &clientInfo{connectedAt: time.Now()}
+	if rc, ok := c.ReadWriteCloser.(interface{ RemoteAddr() net.Addr }); ok {
+		info.remote = rc.RemoteAddr().String()
+	}
+	return info
+}
+
+func (info *clientInfo) read(tlv util.TLV) {
+	info.bytesIn.Add(tlv.L + tlvHeaderSize)
+	info.lastType.Store(uint32(tlv.T))
+}
+
+// ClientInfo is a connected client.
+type ClientInfo struct {
+	Id          uint32    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	Remote      string    `json:"remote,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// BytesIn are read from the client, and BytesOut are forwarded to it.
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	// LastType is the type of the last frame from the client.
+	LastType string `json:"lastType,omitempty"`
+}
+
+// Clients returns the connected clients ordered by id.
+func (s *Server) Clients() []ClientInfo {
+	var cs []ClientInfo
+	s.clients.Range(func(k, v interface{}) bool {
+		id := k.(uint32)
+		i, ok := s.infos.Load(v)
+		if !ok {
+			return true
+		}
+		info := i.(*clientInfo)
+		c := ClientInfo{
+			Id:          id,
+			Remote:      info.remote,
+			ConnectedAt: info.connectedAt,
+			BytesIn:     info.bytesIn.Load(),
+			BytesOut:    info.bytesOut.Load(),
+		}
+		if e, ok := s.registry.lookup(id); ok {
+			c.Name = e.Name
+		}
+		if t := info.lastType.Load(); t != 0 {
+			c.LastType = Type(t).String()
+		}
+		cs = append(cs, c)
+		return true
+	})
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Id < cs[j].Id })
+	return cs
+}
+
+// Disconnect closes client id, and drops its session if any.
+func (s *Server) Disconnect(id uint32) error {
+	v, ok := s.clients.Load(id)
+	if !ok {
+		return noSuchClientErr
+	}
+	if i, ok := s.infos.Load(v); ok {
+		i.(*clientInfo).kicked.Store(true)
+	}
+	s.log.client.Info("disconnect by admin", "client", id)
+	return v.(*client.Client).Close()
+}
+
+// ReconnectDevice closes the device connection, for the device to
+// connect again.
+func (s *Server) ReconnectDevice() error {
+	s.connMu.RLock()
+	conn := s.conn
+	s.connMu.RUnlock()
+	if conn == nil {
+		return noConnectionErr
+	}
+	s.transit(conn, StateGone, "reconnect by admin")
+	return conn.Close()
+}
+
+// SetDeviceAudio requests the audio from the device if on, which is
+// enabled once the device accepts it, or closes the audio otherwise.
+func (s *Server) SetDeviceAudio(on bool) error {
+	s.connMu.RLock()
+	conn := s.conn
+	s.connMu.RUnlock()
+	if conn == nil {
+		return noConnectionErr
+	}
+
+	if on {
+		if conn.AudioEnabled() {
+			return nil
+		}
+		s.log.audio.Info("request audio by admin")
+		return conn.requestAudio()
+	}
+
+	if !conn.disableAudio.CompareAndSwap(false, true) {
+		return nil
+	}
+	s.log.audio.Info("close audio by admin")
+	s.transit(conn, StateReadyNoAudio, "audio closed by admin")
+	return conn.WriteTLV(util.TLV{T: uint64(TypeCloseSound)})
+}
+
+// Send writes a frame of typ with value v from the server to the device
+// if to is "device", or to the client whose id or registered name is to.
+func (s *Server) Send(to string, typ Type, v []byte) error {
+	tlv := util.TLV{T: uint64(typ), L: uint64(len(v)), V: v}
+	if to == "device" {
+		s.connMu.RLock()
+		conn := s.conn
+		s.connMu.RUnlock()
+		if conn == nil {
+			return noConnectionErr
+		}
+		tlv.T |= uint64(ServerAddress) << 32
+		return conn.WriteTLV(tlv)
+	}
+
+	id, err := strconv.ParseUint(to, 10, 32)
+	if err != nil {
+		e, ok := s.registry.lookupName(to)
+		if !ok {
+			return noSuchClientErr
+		}
+		id = uint64(e.Id)
+	}
+	c, ok := s.clients.Load(uint32(id))
+	if !ok {
+		return noSuchClientErr
+	}
+	return s.writeClient(uint32(id), c.(*client.Client), tlv)
+}
+
+// AdminHandler serves the admin api in json, which should be behind
+// RequireToken:
+//
+//	GET  /admin/clients                   the clients, see Clients
+//	POST /admin/clients/{id}/disconnect   see Disconnect
+//	GET  /admin/device                    the device status, see DeviceStatus
+//	POST /admin/device/reconnect          see ReconnectDevice
+//	POST /admin/device/audio?on=false     see SetDeviceAudio
+//	POST /admin/send?type=TypePing&to=42  see Send, the body is the value
+//	GET  /admin/tap?client=42             the frames, see ServeTap
+//	GET  /admin/capture                   see CaptureStatus
+//	POST /admin/capture/start?maxAge=1h   see StartCapture, filtered like tap
+//	POST /admin/capture/stop              see StopCapture
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/clients", allow(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.Clients())
+	}))
+	mux.Handle("/admin/clients/", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		v, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/admin/clients/"), "/disconnect")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid client id", http.StatusBadRequest)
+			return
+		}
+		s.writeResult(w, s.Disconnect(uint32(id)))
+	}))
+	mux.Handle("/admin/device", allow(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.DeviceStatus())
+	}))
+	mux.Handle("/admin/device/reconnect", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		s.writeResult(w, s.ReconnectDevice())
+	}))
+	mux.Handle("/admin/device/audio", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if err != nil {
+			http.Error(w, "invalid on, want true or false", http.StatusBadRequest)
+			return
+		}
+		s.writeResult(w, s.SetDeviceAudio(on))
+	}))
+	mux.Handle("/admin/tap", allow(http.MethodGet, s.ServeTap))
+	mux.Handle("/admin/capture", allow(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.CaptureStatus())
+	}))
+	mux.Handle("/admin/capture/start", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		c, err := parseCaptureConfig(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeResult(w, s.StartCapture(c))
+	}))
+	mux.Handle("/admin/capture/stop", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		st, err := s.StopCapture()
+		if err != nil {
+			s.writeResult(w, err)
+			return
+		}
+		s.writeJSON(w, st)
+	}))
+	mux.Handle("/admin/send", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		typ, ok := ParseType(r.URL.Query().Get("type"))
+		if !ok {
+			http.Error(w, "unknown type", http.StatusBadRequest)
+			return
+		}
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			http.Error(w, "no receiver", http.StatusBadRequest)
+			return
+		}
+		v, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSendSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeResult(w, s.Send(to, typ, v))
+	}))
+	return mux
+}
+
+// allow passes the requests of method to f only.
+func allow(method string, f http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	})
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.server.Error("encode admin response failed", "err", err)
+	}
+}
+
+// writeResult writes the result of an admin action.
+func (s *Server) writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		s.writeJSON(w, struct {
+			Ok bool `json:"ok"`
+		}{true})
+	case err == noSuchClientErr:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == noConnectionErr, err == captureDisabledErr, err == captureRunningErr, err == captureNotRunningErr:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ServeHealthz reports whether the server is serving, with the state of
+// the device link.
+func (s *Server) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	select {
+	case <-s.exit:
+		code = http.StatusServiceUnavailable
+	default:
+		if !s.started.Load() || s.draining.Load() {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	s.writeProbe(w, code, s.DeviceStatus().State)
+}
+
+// ServeReadyz reports whether the device link is up.
+func (s *Server) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusServiceUnavailable
+	st := s.DeviceStatus().State
+	if st == StateReady || st == StateReadyNoAudio {
+		code = http.StatusOK
+	}
+	s.writeProbe(w, code, st)
+}
+
+func (s *Server) writeProbe(w http.ResponseWriter, code int, st ConnState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Ok     bool      `json:"ok"`
+		Device ConnState `json:"device"`
+	}{code == http.StatusOK, st})
+}
+
+// RequireToken passes the requests with the bearer token to h, or denies
+// them. All the requests are denied if token is empty.
+func RequireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseCaptureConfig parses the filter of parseTapFilter, and maxSize in
+// bytes, maxAge as a duration and maxFiles in q.
+func parseCaptureConfig(q url.Values) (CaptureConfig, error) {
+	var (
+		c   CaptureConfig
+		err error
+	)
+	if c.Filter, err = parseTapFilter(q); err != nil {
+		return c, err
+	}
+	if v := q.Get("maxSize"); v != "" {
+		if c.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return c, errors.New("invalid maxSize")
+		}
+	}
+	if v := q.Get("maxAge"); v != "" {
+		if c.MaxAge, err = time.ParseDuration(v); err != nil {
+			return c, errors.New("invalid maxAge")
+		}
+	}
+	if v := q.Get("maxFiles"); v != "" {
+		if c.MaxFiles, err = strconv.Atoi(v); err != nil {
+			return c, errors.New("invalid maxFiles")
+		}
+	}
+	return c, nil
+}
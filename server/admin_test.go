@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// adminRequest sends a request with the token to h and decodes the json
+// response into v if it's not nil.
+func adminRequest(t *testing.T, h http.Handler, method, url, token string, v interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: invalid json %q: %s", method, url, w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdmin(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := RequireToken("secret", s.AdminHandler())
+
+	if code := adminRequest(t, h, "GET", "/admin/clients", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expect %d without token, but got %d", http.StatusUnauthorized, code)
+	}
+	if code := adminRequest(t, h, "GET", "/admin/clients", "bad", nil); code != http.StatusUnauthorized {
+		t.Errorf("expect %d with bad token, but got %d", http.StatusUnauthorized, code)
+	}
+	if code := adminRequest(t, h, "POST", "/admin/device/reconnect", "secret", nil); code != http.StatusConflict {
+		t.Errorf("expect %d without device, but got %d", http.StatusConflict, code)
+	}
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+	waitState(t, s, StateReadyNoAudio)
+
+	clientEnd, err := createClientEnd(s, 900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	register(t, clientEnd, Registration{Name: "scanner"})
+	if err = util.WriteTLV(serverEnd, util.TLV{T: 900<<32 | uint64(TypeScanCode)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = util.ReadTLV(clientEnd); err != nil {
+		t.Fatal(err)
+	}
+	// the registration and the scan code, counted after the write returns
+	bytesOut := uint64(16+10) + 16
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cs := s.Clients(); len(cs) > 0 && cs[0].BytesOut == bytesOut {
+			break
+		}
+	}
+
+	var clients []ClientInfo
+	if code := adminRequest(t, h, "GET", "/admin/clients", "secret", &clients); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	if len(clients) != 1 {
+		t.Fatalf("expect 1 client, but got %+v", clients)
+	}
+	if c := clients[0]; c.Id != 900 || c.Name != "scanner" || c.LastType != "TypeRegister" ||
+		c.BytesIn != 34 || c.BytesOut != bytesOut || c.ConnectedAt.IsZero() {
+		t.Errorf("unexpected %+v", c)
+	}
+
+	// turn on the audio
+	if code := adminRequest(t, h, "POST", "/admin/device/audio?on=true", "secret", nil); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	tlv, err := util.ReadTLV(serverEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Type(tlv.T) != TypeOpenSound {
+		t.Fatalf("expect %v, but got %v", TypeOpenSound, tlv)
+	}
+	if err = util.WriteTLV(serverEnd, util.TLV{T: uint64(TypeOpenSound)}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, StateReady)
+	var st Status
+	adminRequest(t, h, "GET", "/admin/device", "secret", &st)
+	if st.Audio == nil || *st.Audio != defaultAudioFormat {
+		t.Errorf("expect audio %+v, but got %+v", defaultAudioFormat, st.Audio)
+	}
+
+	// and off
+	done := make(chan util.TLV)
+	go func() {
+		tlv, _ := util.ReadTLV(serverEnd)
+		done <- tlv
+	}()
+	if code := adminRequest(t, h, "POST", "/admin/device/audio?on=false", "secret", nil); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	if tlv = <-done; Type(tlv.T) != TypeCloseSound {
+		t.Fatalf("expect %v, but got %v", TypeCloseSound, tlv)
+	}
+	waitState(t, s, StateReadyNoAudio)
+	if code := adminRequest(t, h, "POST", "/admin/device/audio?on=maybe", "secret", nil); code != http.StatusBadRequest {
+		t.Errorf("expect %d, but got %d", http.StatusBadRequest, code)
+	}
+
+	// send frames from the server
+	if code := adminRequest(t, h, "POST", "/admin/send?type=TypePing&to=device", "secret", nil); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	if tlv, err = util.ReadTLV(serverEnd); err != nil || tlv.T != uint64(ServerAddress)<<32|uint64(TypePing) {
+		t.Fatalf("expect a ping from the server, but got %v, %v", tlv, err)
+	}
+	go func() {
+		tlv, _ := util.ReadTLV(clientEnd)
+		done <- tlv
+	}()
+	r := httptest.NewRequest("POST", "/admin/send?type=TypeMessage&to=scanner", strings.NewReader("hi"))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, w.Code)
+	}
+	if tlv = <-done; Type(tlv.T) != TypeMessage || string(tlv.V) != "hi" {
+		t.Fatalf("expect a message, but got %v", tlv)
+	}
+	for _, c := range []struct {
+		url  string
+		code int
+	}{
+		{"/admin/send?type=TypeNothing&to=device", http.StatusBadRequest},
+		{"/admin/send?type=TypePing", http.StatusBadRequest},
+		{"/admin/send?type=TypePing&to=nobody", http.StatusNotFound},
+	} {
+		if code := adminRequest(t, h, "POST", c.url, "secret", nil); code != c.code {
+			t.Errorf("%s: expect %d, but got %d", c.url, c.code, code)
+		}
+	}
+
+	// the client is kicked without a session
+	if code := adminRequest(t, h, "POST", "/admin/clients/1/disconnect", "secret", nil); code != http.StatusNotFound {
+		t.Errorf("expect %d, but got %d", http.StatusNotFound, code)
+	}
+	if _, err = oneShotRequest(clientEnd, util.TLV{T: uint64(TypeResume)}); err != nil {
+		t.Fatal(err)
+	}
+	if code := adminRequest(t, h, "POST", "/admin/clients/900/disconnect", "secret", nil); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	if _, err = util.ReadTLV(clientEnd); err == nil {
+		t.Error("expect the client is closed")
+	}
+	for deadline := time.Now().Add(time.Second); s.numClients() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n, _ := s.sessions.depth(); n != 0 {
+		t.Errorf("expect no session kept, but got %d", n)
+	}
+
+	// the device is dropped
+	if code := adminRequest(t, h, "POST", "/admin/device/reconnect", "secret", nil); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	if _, err = util.ReadTLV(serverEnd); err == nil {
+		t.Error("expect the device is closed")
+	}
+}
+
+func TestProbes(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	probe := func(f http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		f(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+	if code := probe(s.ServeHealthz); code != http.StatusOK {
+		t.Errorf("expect healthy, but got %d", code)
+	}
+	if code := probe(s.ServeReadyz); code != http.StatusServiceUnavailable {
+		t.Errorf("expect not ready without device, but got %d", code)
+	}
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+	waitState(t, s, StateReadyNoAudio)
+	if code := probe(s.ServeReadyz); code != http.StatusOK {
+		t.Errorf("expect ready, but got %d", code)
+	}
+
+	s.Close()
+	if code := probe(s.ServeHealthz); code != http.StatusServiceUnavailable {
+		t.Errorf("expect unhealthy after close, but got %d", code)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// Identity is a client identity together with the types it may send.
+type Identity struct {
+	Name   string   `json:"-"`
+	Token  string   `json:"token,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+	Allow  []string `json:"allow"`
+
+	all   bool
+	allow map[Type]bool
+}
+
+// Allowed reports whether the identity may send frames of type t.
+// A nil identity (authentication disabled) is allowed everything.
+func (id *Identity) Allowed(t Type) bool {
+	if id == nil {
+		return true
+	}
+	return id.all || id.allow[t]
+}
+
+// Auth is the client authentication config, loaded from a json file like:
+//
+//	{
+//		"identities": {
+//			"kiosk": {"token": "xxx", "allow": ["TypeScanCode", "TypePing"]},
+//			"ui": {"secret": "yyy", "allow": ["*"]}
+//		}
+//	}
+type Auth struct {
+	Identities map[string]*Identity `json:"identities"`
+}
+
+func LoadAuth(path string) (*Auth, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuth(data)
+}
+
+func ParseAuth(data []byte) (*Auth, error) {
+	a := &Auth{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+
+	for name, id := range a.Identities {
+		if id == nil || (id.Token == "" && id.Secret == "") {
+			return nil, fmt.Errorf("identity %q has neither token nor secret", name)
+		}
+		id.Name = name
+		id.allow = make(map[Type]bool)
+		for _, s := range id.Allow {
+			if s == "*" {
+				id.all = true
+				continue
+			}
+			t, ok := ParseType(s)
+			if !ok {
+				return nil, fmt.Errorf("identity %q: unknown type %q", name, s)
+			}
+			id.allow[t] = true
+		}
+	}
+	return a, nil
+}
+
+type authRequest struct {
+	Name     string `json:"name"`
+	Token    string `json:"token,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+type authChallenge struct {
+	Challenge string `json:"challenge"`
+}
+
+const challengeSize = 32
+
+var permissionDeniedErr = errors.New("permission denied")
+
+// ChallengeResponse is what a client holding secret answers to challenge.
+func ChallengeResponse(secret string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+func readAuthRequest(r io.Reader) (req authRequest, err error) {
+	tlv, err := util.ReadTLV(r)
+	if err != nil {
+		return
+	}
+	if Type(tlv.T) != TypeAuth {
+		err = fmt.Errorf("%w: expect %v, but got type[%#x]", permissionDeniedErr, TypeAuth, tlv.T)
+		return
+	}
+	if err = json.Unmarshal(tlv.V, &req); err != nil {
+		err = fmt.Errorf("%w: %s", permissionDeniedErr, err)
+	}
+	return
+}
+
+// Authenticate runs the handshake on the first frames from rw.
+//
+// The client either presents a token:
+//
+//	client: TypeAuth {"name": "kiosk", "token": "xxx"}
+//	server: TypeAuth
+//
+// or proves it knows the secret:
+//
+//	client: TypeAuth {"name": "ui"}
+//	server: TypeAuth {"challenge": hex(nonce)}
+//	client: TypeAuth {"name": "ui", "response": hex(hmac-sha256(secret, nonce))}
+//	server: TypeAuth
+//
+// A peer whose verified certificate subject names an identity is
+// authenticated as it without any handshake.
+func (a *Auth) Authenticate(rw io.ReadWriter, peer string) (*Identity, error) {
+	if id, ok := a.Identities[peer]; ok && peer != "" {
+		return id, nil
+	}
+
+	req, err := readAuthRequest(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := a.Identities[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown identity %q", permissionDeniedErr, req.Name)
+	}
+
+	switch {
+	case req.Token != "":
+		if id.Token == "" || subtle.ConstantTimeCompare([]byte(req.Token), []byte(id.Token)) != 1 {
+			return nil, fmt.Errorf("%w: bad token for %q", permissionDeniedErr, req.Name)
+		}
+	case id.Secret != "":
+		challenge := make([]byte, challengeSize)
+		if _, err = rand.Read(challenge); err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(authChallenge{Challenge: hex.EncodeToString(challenge)})
+		if err != nil {
+			return nil, err
+		}
+		err = util.WriteTLV(rw, util.TLV{T: uint64(TypeAuth), L: uint64(len(v)), V: v})
+		if err != nil {
+			return nil, err
+		}
+
+		req, err = readAuthRequest(rw)
+		if err != nil {
+			return nil, err
+		}
+		response, err := hex.DecodeString(req.Response)
+		if err != nil || req.Name != id.Name || !hmac.Equal(response, ChallengeResponse(id.Secret, challenge)) {
+			return nil, fmt.Errorf("%w: bad challenge response for %q", permissionDeniedErr, id.Name)
+		}
+	default:
+		return nil, fmt.Errorf("%w: no credential for %q", permissionDeniedErr, req.Name)
+	}
+
+	if err = util.WriteTLV(rw, util.TLV{T: uint64(TypeAuth)}); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+const testAuthConfig = `{
+	"identities": {
+		"kiosk": {"token": "kiosk-token", "allow": ["TypeScanCode"]},
+		"ui": {"secret": "ui-secret", "allow": ["*"]}
+	}
+}`
+
+func authTLV(t *testing.T, req authRequest) util.TLV {
+	v, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return util.TLV{T: uint64(TypeAuth), L: uint64(len(v)), V: v}
+}
+
+func TestParseAuth(t *testing.T) {
+	for name, c := range map[string]struct {
+		data      string
+		expectErr bool
+	}{
+		"normal":       {data: testAuthConfig},
+		"noCredential": {data: `{"identities": {"a": {"allow": ["*"]}}}`, expectErr: true},
+		"unknownType":  {data: `{"identities": {"a": {"token": "t", "allow": ["TypeFoo"]}}}`, expectErr: true},
+		"malform":      {data: `{`, expectErr: true},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseAuth([]byte(c.data))
+			if (err != nil) != c.expectErr {
+				t.Errorf("expect error %v, but got %v", c.expectErr, err)
+			}
+		})
+	}
+
+	a, err := ParseAuth([]byte(testAuthConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kiosk := a.Identities["kiosk"]
+	if !kiosk.Allowed(TypeScanCode) || kiosk.Allowed(TypeOpenMic) {
+		t.Errorf("kiosk should only be allowed to send %v", TypeScanCode)
+	}
+	if ui := a.Identities["ui"]; !ui.Allowed(TypeOpenMic) {
+		t.Errorf("ui should be allowed to send everything")
+	}
+	if (*Identity)(nil).Allowed(TypeOpenMic) != true {
+		t.Errorf("nil identity should be allowed to send everything")
+	}
+}
+
+func newAuthServer(t *testing.T) *Server {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	a, err := ParseAuth([]byte(testAuthConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuth(a)
+	return s
+}
+
+func TestAuthToken(t *testing.T) {
+	s := newAuthServer(t)
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	clientEnd, err := createClientEnd(s, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+
+	got, err := oneShotRequest(clientEnd, authTLV(t, authRequest{Name: "kiosk", Token: "kiosk-token"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := util.TLV{T: uint64(TypeAuth), V: []byte{}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	// not allowed, including the ones handled by the server
+	expect = util.TLV{T: uint64(ErrorPermissionDenied), V: []byte{}}
+	for _, typ := range []Type{TypeOpenMic, TypeRegister, TypeStatus, TypeResume} {
+		got, err = oneShotRequest(clientEnd, util.TLV{T: uint64(typ)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %v for %v, but got %v", expect, typ, got)
+		}
+	}
+
+	// allowed
+	err = util.WriteTLV(clientEnd, util.TLV{T: uint64(TypeScanCode)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = util.ReadTLV(serverEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = util.TLV{T: 1<<32 | uint64(TypeScanCode), V: []byte{}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+}
+
+func TestAuthChallenge(t *testing.T) {
+	s := newAuthServer(t)
+	defer s.Close()
+
+	for name, secret := range map[string]string{
+		"goodSecret": "ui-secret",
+		"badSecret":  "guess",
+	} {
+		clientEnd, err := createClientEnd(s, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := oneShotRequest(clientEnd, authTLV(t, authRequest{Name: "ui"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c authChallenge
+		if Type(got.T) != TypeAuth || json.Unmarshal(got.V, &c) != nil {
+			t.Fatalf("%s: expect a challenge, but got %v", name, got)
+		}
+		challenge, err := hex.DecodeString(c.Challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response := hex.EncodeToString(ChallengeResponse(secret, challenge))
+		got, err = oneShotRequest(clientEnd, authTLV(t, authRequest{Name: "ui", Response: response}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := util.TLV{T: uint64(TypeAuth), V: []byte{}}
+		if secret != "ui-secret" {
+			expect.T = uint64(ErrorPermissionDenied)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: expect %v, but got %v", name, expect, got)
+		}
+		clientEnd.Close()
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	s := newAuthServer(t)
+	defer s.Close()
+
+	for name, req := range map[string]util.TLV{
+		"notAuth":      {T: uint64(TypeOpenMic)},
+		"badToken":     authTLV(t, authRequest{Name: "kiosk", Token: "guess"}),
+		"unknownName":  authTLV(t, authRequest{Name: "nobody", Token: "kiosk-token"}),
+		"noCredential": authTLV(t, authRequest{Name: "kiosk"}),
+	} {
+		clientEnd, err := createClientEnd(s, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := oneShotRequest(clientEnd, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := util.TLV{T: uint64(ErrorPermissionDenied), V: []byte{}}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: expect %v, but got %v", name, expect, got)
+		}
+		clientEnd.Close()
+	}
+}
+
+func TestAuthInvisible(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true, HandshakeTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	a, err := ParseAuth([]byte(testAuthConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuth(a)
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	// never authenticates
+	clientEnd, err := createClientEnd(s, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	if !s.idInUse(1) {
+		t.Error("expect the id reserved during the authentication")
+	}
+
+	err = util.WriteTLV(serverEnd, util.TLV{T: uint64(BroadcastAddress)<<32 | uint64(TypeScanCode), L: 1, V: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// denied and closed at the deadline without the broadcast
+	for {
+		got, err := util.ReadTLV(clientEnd)
+		if err != nil {
+			break
+		}
+		if Type(got.T) != ErrorPermissionDenied {
+			t.Fatalf("expect denied, but got %v", got)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s.idInUse(1) {
+		t.Error("expect the id released")
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/capture"
+)
+
+// captureBuffer is the number of frames a capture holds before dropping.
+const captureBuffer = 4096
+
+var (
+	captureDisabledErr   = errors.New("capture is disabled")
+	captureRunningErr    = errors.New("capture is running")
+	captureNotRunningErr = errors.New("capture is not running")
+)
+
+// CaptureConfig configures a capture, zero fields take the defaults of
+// capture.RingConfig.
+type CaptureConfig struct {
+	Filter TapFilter
+	// MaxSize is the size in bytes to rotate a file at.
+	MaxSize int64
+	// MaxAge is how long to write a file before rotating it.
+	MaxAge time.Duration
+	// MaxFiles is the number of files kept.
+	MaxFiles int
+}
+
+// CaptureStatus is the status of the last capture.
+type CaptureStatus struct {
+	Running bool      `json:"running"`
+	Since   time.Time `json:"since"`
+	// Files are the files kept, from the oldest.
+	Files   []string `json:"files,omitempty"`
+	Frames  uint64   `json:"frames"`
+	Dropped uint64   `json:"dropped"`
+	// Error is why the capture stopped by itself.
+	Error string `json:"error,omitempty"`
+}
+
+// recording is a capture started.
+type recording struct {
+	since   time.Time
+	dropped func() uint64
+	quit    chan struct{}
+	done    chan struct{}
+	frames  atomic.Uint64
+
+	mu   sync.Mutex
+	ring *capture.Ring
+	err  error
+}
+
+func (rec *recording) running() bool {
+	select {
+	case <-rec.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (rec *recording) status() CaptureStatus {
+	st := CaptureStatus{
+		Running: rec.running(),
+		Since:   rec.since,
+		Frames:  rec.frames.Load(),
+		Dropped: rec.dropped(),
+	}
+	rec.mu.Lock()
+	st.Files = rec.ring.Files()
+	if rec.err != nil {
+		st.Error = rec.err.Error()
+	}
+	rec.mu.Unlock()
+	return st
+}
+
+// StartCapture writes the frames read from the device and the clients
+// matching c to a ring of pcapng files in Config.CaptureDir until
+// StopCapture, see package capture. Only one capture runs at a time.
+func (s *Server) StartCapture(c CaptureConfig) error {
+	if s.config.CaptureDir == "" {
+		return captureDisabledErr
+	}
+	select {
+	case <-s.exit:
+		return ErrServerClosed
+	default:
+	}
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	if s.rec != nil && s.rec.running() {
+		return captureRunningErr
+	}
+
+	ring, err := capture.NewRing(capture.RingConfig{
+		Dir:      s.config.CaptureDir,
+		Prefix:   "servicemgr",
+		MaxSize:  c.MaxSize,
+		MaxAge:   c.MaxAge,
+		MaxFiles: c.MaxFiles,
+	})
+	if err != nil {
+		return err
+	}
+	frames, dropped, stop := s.tapFrames(c.Filter, captureBuffer)
+	rec := &recording{
+		since:   time.Now(),
+		dropped: dropped,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		ring:    ring,
+	}
+	s.rec = rec
+	s.spawn(func() {
+		defer close(rec.done)
+		defer stop()
+		s.record(rec, frames)
+	})
+	s.log.server.Info("capture started", "dir", s.config.CaptureDir)
+	return nil
+}
+
+// StopCapture stops the capture, and returns its status.
+func (s *Server) StopCapture() (CaptureStatus, error) {
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	if s.rec == nil || !s.rec.running() {
+		return CaptureStatus{}, captureNotRunningErr
+	}
+	close(s.rec.quit)
+	<-s.rec.done
+	st := s.rec.status()
+	s.log.server.Info("capture stopped", "frames", st.Frames, "dropped", st.Dropped)
+	return st, nil
+}
+
+// CaptureStatus returns the status of the running or the last capture.
+func (s *Server) CaptureStatus() CaptureStatus {
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	if s.rec == nil {
+		return CaptureStatus{}
+	}
+	return s.rec.status()
+}
+
+// record writes the frames until the capture is stopped, the server is
+// closed or the write fails.
+func (s *Server) record(rec *recording, frames <-chan tappedFrame) {
+	var err error
+loop:
+	for err == nil {
+		select {
+		case f := <-frames:
+			// flush once idle, so the files are readable while capturing
+			err = rec.write(f, len(frames) == 0)
+		case <-rec.quit:
+			break loop
+		case <-s.exit:
+			break loop
+		}
+	}
+
+	rec.mu.Lock()
+	if e := rec.ring.Close(); err == nil {
+		err = e
+	}
+	rec.err = err
+	rec.mu.Unlock()
+	if err != nil {
+		s.log.server.Error("capture failed", "err", err)
+	}
+}
+
+func (rec *recording) write(f tappedFrame, flush bool) error {
+	peer := capture.DevicePeer
+	if f.direction == fromClient {
+		peer = capture.ClientPeer(f.id)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := rec.ring.WriteTLV(peer, f.time, f.tlv); err != nil {
+		return err
+	}
+	rec.frames.Add(1)
+	if flush {
+		return rec.ring.Flush()
+	}
+	return nil
+}
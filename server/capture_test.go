@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/capture"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestCapture(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.StartCapture(CaptureConfig{}); err != captureDisabledErr {
+		t.Errorf("expect %v, but got %v", captureDisabledErr, err)
+	}
+	s.Close()
+
+	s, err = newTestServer(Config{DisableAudio: true, CaptureDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := s.AdminHandler()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+	clientEnd, err := createClientEnd(s, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+
+	if code := adminRequest(t, h, "POST", "/admin/capture/start?maxSize=x", "", nil); code != http.StatusBadRequest {
+		t.Errorf("expect %d, but got %d", http.StatusBadRequest, code)
+	}
+	if code := adminRequest(t, h, "POST", "/admin/capture/start?type=TypeScanCode", "", nil); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	if code := adminRequest(t, h, "POST", "/admin/capture/start", "", nil); code != http.StatusConflict {
+		t.Errorf("expect %d for a running capture, but got %d", http.StatusConflict, code)
+	}
+
+	for _, v := range []util.TLV{
+		{T: uint64(TypePing)},
+		{T: uint64(TypeScanCode), L: 2, V: []byte("42")},
+	} {
+		if err = util.WriteTLV(clientEnd, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = util.ReadTLV(serverEnd); err != nil {
+		t.Fatal(err)
+	}
+	if err = util.WriteTLV(serverEnd, util.TLV{T: 800<<32 | uint64(TypeScanCode), L: 1, V: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = util.ReadTLV(clientEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	var st CaptureStatus
+	for deadline := time.Now().Add(time.Second); s.CaptureStatus().Frames < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if code := adminRequest(t, h, "POST", "/admin/capture/stop", "", &st); code != http.StatusOK {
+		t.Fatalf("expect %d, but got %d", http.StatusOK, code)
+	}
+	if st.Running || st.Frames != 2 || st.Dropped != 0 || len(st.Files) != 1 || st.Error != "" {
+		t.Fatalf("unexpected %+v", st)
+	}
+	if code := adminRequest(t, h, "POST", "/admin/capture/stop", "", nil); code != http.StatusConflict {
+		t.Errorf("expect %d for no capture, but got %d", http.StatusConflict, code)
+	}
+
+	f, err := os.Open(st.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := capture.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []capture.Frame{
+		{Peer: capture.ClientPeer(800), TLV: util.TLV{T: uint64(TypeScanCode), L: 2, V: []byte("42")}},
+		{Peer: capture.DevicePeer, TLV: util.TLV{T: 800<<32 | uint64(TypeScanCode), L: 1, V: []byte{1}}},
+	} {
+		frame, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Peer != expect.Peer || frame.TLV.String() != expect.TLV.String() || frame.Time.IsZero() {
+			t.Errorf("expect %+v, but got %+v", expect, frame)
+		}
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Errorf("expect EOF, but got %v", err)
+	}
+
+	// stopped with the server
+	if err = s.StartCapture(CaptureConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if st = s.CaptureStatus(); st.Running {
+		t.Errorf("expect stopped after close, but got %+v", st)
+	}
+}
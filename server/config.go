@@ -0,0 +1,86 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	DefaultHandshakeTimeout   = 10 * time.Second
+	DefaultAudioRetryInterval = 30 * time.Second
+	DefaultMaxMissed          = 3
+	DefaultResumeGrace        = 10 * time.Second
+	DefaultShutdownTimeout    = 10 * time.Second
+)
+
+// Config configures a Server, zero fields take the defaults.
+type Config struct {
+	// Logger gets all the logs with their subsystems, see package
+	// logging. It's the default logger if nil.
+	Logger *slog.Logger
+	// Observer gets all the events, see Observe.
+	Observer Observer
+
+	// Listen creates the listeners for ListenAndServe, net.Listen if nil.
+	Listen func(network, address string) (net.Listener, error)
+
+	// Auth authenticates the clients, see SetAuth.
+	Auth *Auth
+	// PSK authenticates the devices, see SetPSK.
+	PSK []byte
+	// Admission limits the devices and clients, see SetAdmission.
+	Admission *Admission
+	// Groups are the client groups for multicast, see SetGroups.
+	Groups Groups
+
+	// HandshakeTimeout is how long a device or a client has to finish the
+	// handshakes. A device answering the audio request late is kept
+	// without audio, which is requested again.
+	HandshakeTimeout time.Duration
+	// DisableAudio skips opening the sound on the device.
+	DisableAudio bool
+	// AudioRetryInterval is the interval to request audio again after
+	// the device refused it.
+	AudioRetryInterval time.Duration
+
+	// PingInterval is the interval to ping the device and the idle
+	// clients, zero disables the heartbeat.
+	PingInterval time.Duration
+	// MaxMissed is the number of pings missed in a row to close a peer.
+	MaxMissed int
+
+	// ResumeGrace is how long a dropped client could resume its session.
+	ResumeGrace time.Duration
+	// ShutdownTimeout is how long Serve takes to tell the clients to leave
+	// after its context is done, see Shutdown.
+	ShutdownTimeout time.Duration
+
+	// CaptureDir is where the captures are written, see StartCapture.
+	// Capturing is disabled if empty.
+	CaptureDir string
+}
+
+func (c *Config) setDefaults() {
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	if c.Listen == nil {
+		c.Listen = net.Listen
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.AudioRetryInterval <= 0 {
+		c.AudioRetryInterval = DefaultAudioRetryInterval
+	}
+	if c.MaxMissed <= 0 {
+		c.MaxMissed = DefaultMaxMissed
+	}
+	if c.ResumeGrace <= 0 {
+		c.ResumeGrace = DefaultResumeGrace
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+}
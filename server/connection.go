@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+const keepAlivePeriod = 30 * time.Second
+
+const (
+	audioFormat  = 2     // pcm 16 bit
+	audioRate    = 44100 // sample rate
+	audioChannel = 2     // channel count
+)
+
+// AudioFormat is the format of the sound requested from the device.
+type AudioFormat struct {
+	Format  int `json:"format"`
+	Rate    int `json:"rate"`
+	Channel int `json:"channel"`
+}
+
+var defaultAudioFormat = AudioFormat{
+	Format:  audioFormat,
+	Rate:    audioRate,
+	Channel: audioChannel,
+}
+
+func MakeKeepAlive(c net.Conn) net.Conn {
+	raw := c
+	if tc, ok := c.(*tls.Conn); ok {
+		raw = tc.NetConn()
+	}
+	if tc, ok := raw.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(keepAlivePeriod)
+	}
+	return c
+}
+
+type Connection struct {
+	disableAudio atomic.Bool
+	// the link is up, only the audio handshake could fail afterwards
+	established bool
+	identity    string
+	psk         *pskChannel
+	health      *peerHealth
+	log         loggers
+	// counts the frames written
+	written func(util.TLV)
+
+	stateMu    sync.Mutex
+	state      ConnState
+	stateSince time.Time
+	// when it's accepted
+	connectedAt time.Time
+
+	// closed when the connection is no longer polled
+	done chan struct{}
+	net.Conn
+}
+
+// createConnection sets up the device link on c. If psk isn't empty,
+// the device must complete the psk handshake and all the frames are
+// authenticated with it afterwards.
+//
+// If only the audio handshake fails, the returned connection is still
+// established (see Established) and usable with audio disabled.
+func (s *Server) createConnection(c net.Conn, psk []byte) (*Connection, error) {
+	conn := &Connection{
+		health:      newPeerHealth(),
+		log:         s.log,
+		written:     func(tlv util.TLV) { s.countFrame(toDevice, 0, tlv) },
+		connectedAt: time.Now(),
+		done:        make(chan struct{}),
+		Conn:        MakeKeepAlive(c),
+	}
+	conn.disableAudio.Store(true)
+	s.transit(conn, StateHandshaking, "accepted")
+
+	identity, err := PeerIdentity(c)
+	if err != nil {
+		return conn, err
+	}
+	conn.identity = identity
+
+	if len(psk) != 0 {
+		conn.psk, err = pskServerHandshake(conn.Conn, psk)
+		if err != nil {
+			atomic.AddUint64(&s.pskFailures, 1)
+			return conn, err
+		}
+	}
+
+	conn.established = true
+	if s.config.DisableAudio {
+		return conn, nil
+	}
+
+	err = conn.initAudio()
+	if err != nil {
+		return conn, err
+	}
+
+	return conn, nil
+}
+
+// Identity returns the subject of the device's verified certificate,
+// or empty if it doesn't have one.
+func (conn *Connection) Identity() string {
+	return conn.identity
+}
+
+// Established reports whether the link is up regardless of audio.
+func (conn *Connection) Established() bool {
+	return conn.established
+}
+
+// AudioEnabled reports whether the device accepted the audio request.
+func (conn *Connection) AudioEnabled() bool {
+	return !conn.disableAudio.Load()
+}
+
+// requestAudio asks the device to open the sound, it replies
+// TypeOpenSound if it accepts.
+func (conn *Connection) requestAudio() error {
+	req, err := json.Marshal(defaultAudioFormat)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteTLV(util.TLV{
+		T: uint64(TypeOpenSound),
+		L: uint64(len(req)),
+		V: req,
+	})
+}
+
+func (conn *Connection) initAudio() error {
+	err := conn.requestAudio()
+	if err != nil {
+		return err
+	}
+	tlv, err := conn.ReadTLV()
+	if err != nil {
+		return err
+	}
+	if Type(tlv.T) != TypeOpenSound {
+		conn.log.audio.Warn("unmatched audio reply", "type", Type(tlv.T), "want", TypeOpenSound)
+		return dataInvalidErr
+	}
+
+	// enable audio
+	conn.disableAudio.Store(false)
+
+	return nil
+}
+
+func (conn *Connection) WriteTLV(tlv util.TLV) error {
+	t := Type(tlv.T & 0x00000000ffffffff)
+
+	if t == TypeSoundData && conn.disableAudio.Load() {
+		conn.log.audio.Debug("audio is disabled, skip audio data")
+		return nil
+	}
+
+	var err error
+	if conn.psk != nil {
+		err = conn.psk.WriteTLV(conn.Conn, tlv)
+	} else {
+		err = util.WriteTLV(conn.Conn, tlv)
+	}
+	if err == nil && conn.written != nil {
+		conn.written(tlv)
+	}
+	return err
+}
+
+func (conn *Connection) ReadTLV() (util.TLV, error) {
+	if conn.psk != nil {
+		return conn.psk.ReadTLV(conn.Conn)
+	}
+	return util.ReadTLV(conn.Conn)
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"encoding/json"
@@ -10,12 +10,6 @@ import (
 )
 
 func TestInitAudio(t *testing.T) {
-	old := test
-	test = false
-	defer func() {
-		test = old
-	}()
-
 	c1, c2 := net.Pipe()
 	defer func() {
 		c1.Close()
@@ -39,7 +33,8 @@ func TestInitAudio(t *testing.T) {
 			Channel: audioChannel,
 		})
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		expect := util.TLV{
@@ -49,7 +44,7 @@ func TestInitAudio(t *testing.T) {
 		}
 		got, err := util.ReadTLV(c2)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 			return
 		}
 		if !reflect.DeepEqual(expect, got) {
@@ -60,13 +55,13 @@ func TestInitAudio(t *testing.T) {
 		// mock success at first
 		err = util.WriteTLV(c2, util.TLV{T: uint64(TypeOpenSound)})
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 			return
 		}
 
 		got, err = util.ReadTLV(c2)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 			return
 		}
 		if !reflect.DeepEqual(expect, got) {
@@ -77,26 +72,30 @@ func TestInitAudio(t *testing.T) {
 		// mock failure then
 		err = util.WriteTLV(c2, util.TLV{T: 0xdead})
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 			return
 		}
 	}()
 
-	conn, err := CreateConnection(c1)
+	s := NewServer(Config{})
+	conn, err := s.createConnection(c1, nil)
 	if err != nil {
 		t.Errorf("got unexpected error: %v", err)
 	}
-	if conn.disableAudio {
+	if !conn.AudioEnabled() {
 		t.Errorf("expect audio work, but not")
 	}
 
-	conn, err = CreateConnection(c1)
+	conn, err = s.createConnection(c1, nil)
 	if err != dataInvalidErr {
 		t.Errorf("not got expected error: %v", dataInvalidErr)
 	}
-	if !conn.disableAudio {
+	if conn.AudioEnabled() {
 		t.Errorf("expect audio doesn't work, but it does")
 	}
+	if !conn.Established() {
+		t.Errorf("expect connection established without audio")
+	}
 
 	// wait goroutine exit
 	<-done
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// ClientJoined is emitted when a client is added.
+	ClientJoined EventType = iota
+	// ClientRejected is emitted when a client isn't admitted.
+	ClientRejected
+	// ClientLeft is emitted when a client is gone.
+	ClientLeft
+	// DeviceConnected is emitted when a device is accepted, before
+	// the handshake.
+	DeviceConnected
+	// DeviceReady is emitted when a device finishes the handshake and
+	// becomes the current connection.
+	DeviceReady
+	// DeviceDropped is emitted when a device fails the handshake or
+	// its connection is gone.
+	DeviceDropped
+	// FrameRejected is emitted when a frame from a client or the device
+	// isn't forwarded.
+	FrameRejected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ClientJoined:
+		return "ClientJoined"
+	case ClientRejected:
+		return "ClientRejected"
+	case ClientLeft:
+		return "ClientLeft"
+	case DeviceConnected:
+		return "DeviceConnected"
+	case DeviceReady:
+		return "DeviceReady"
+	case DeviceDropped:
+		return "DeviceDropped"
+	case FrameRejected:
+		return "FrameRejected"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is something happened in the server.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	// the client of client events and rejected frames from clients,
+	// the name is empty if it isn't registered
+	ClientId   uint32 `json:"clientId,omitempty"`
+	ClientName string `json:"clientName,omitempty"`
+
+	// the device of device events and rejected frames from the device,
+	// its identity is empty without a certificate
+	Device string `json:"device,omitempty"`
+	// whether the device accepted the audio request, for DeviceReady
+	Audio bool `json:"audio,omitempty"`
+
+	// the remote address of the client or the device
+	Remote string `json:"remote,omitempty"`
+	// the type of the rejected frame, and whether it's from the device
+	// (to ClientId) or from the client
+	Frame      Type `json:"frame,omitempty"`
+	FromDevice bool `json:"fromDevice,omitempty"`
+	// why the client or device is gone, or the frame is rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+// Observer gets the events of a server. It's called synchronously
+// where the event happens, so it should return quickly.
+type Observer func(Event)
+
+// Observe adds o to get all the events afterwards.
+func (s *Server) Observe(o Observer) {
+	s.observersMu.Lock()
+	s.observers = append(s.observers, o)
+	s.observersMu.Unlock()
+}
+
+func (s *Server) emit(e Event) {
+	s.observersMu.RLock()
+	observers := s.observers
+	s.observersMu.RUnlock()
+	if len(observers) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+	if e.ClientId != 0 && e.ClientName == "" {
+		if entry, ok := s.registry.lookup(e.ClientId); ok {
+			e.ClientName = entry.Name
+		}
+	}
+	for _, o := range observers {
+		o(e)
+	}
+}
+
+// emitClient emits an event of client id from ip.
+func (s *Server) emitClient(typ EventType, id uint32, ip net.IP, reason string) {
+	e := Event{Type: typ, ClientId: id, Reason: reason}
+	if ip != nil {
+		e.Remote = ip.String()
+	}
+	s.emit(e)
+}
+
+// emitDevice emits an event of the device on c.
+func (s *Server) emitDevice(typ EventType, c net.Conn, identity string, reason string) {
+	s.emit(Event{Type: typ, Device: identity, Remote: c.RemoteAddr().String(), Reason: reason})
+}
+
+// emitFrame emits a FrameRejected of typ from client id, or from the
+// device to client id.
+func (s *Server) emitFrame(fromDevice bool, id uint32, typ Type, reason string) {
+	s.metrics.forwardErrors.add(1, "reason", reason)
+	s.emit(Event{Type: FrameRejected, ClientId: id, Frame: typ, FromDevice: fromDevice, Reason: reason})
+}
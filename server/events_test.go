@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// waitEvent waits for the next event of typ, skipping the others.
+func waitEvent(t *testing.T, events <-chan Event, typ EventType) Event {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("wait %v timeout", typ)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	events := make(chan Event, 64)
+	s, err := newTestServer(Config{
+		DisableAudio: true,
+		Observer:     func(e Event) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, events, DeviceConnected)
+	if e := waitEvent(t, events, DeviceReady); e.Remote == "" || e.Time.IsZero() {
+		t.Errorf("expect remote address and time, but got %+v", e)
+	}
+
+	clientEnd, err := createClientEnd(s, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	if e := waitEvent(t, events, ClientJoined); e.ClientId != 800 {
+		t.Errorf("expect client 800 joined, but got %+v", e)
+	}
+	register(t, clientEnd, Registration{Name: "scanner"})
+
+	res, err := oneShotRequest(clientEnd, util.TLV{T: 0xdead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Type(res.T) != ErrorInvalidType {
+		t.Fatalf("expect %v, but got %v", ErrorInvalidType, res)
+	}
+	e := waitEvent(t, events, FrameRejected)
+	if e.ClientId != 800 || e.ClientName != "scanner" || e.Frame != 0xdead || e.FromDevice {
+		t.Errorf("unexpected %+v", e)
+	}
+
+	clientEnd.Close()
+	if e := waitEvent(t, events, ClientLeft); e.ClientId != 800 || e.ClientName != "scanner" || e.Reason == "" {
+		t.Errorf("unexpected %+v", e)
+	}
+
+	serverEnd.Close()
+	if e := waitEvent(t, events, DeviceDropped); e.Reason == "" {
+		t.Errorf("expect a reason, but got %+v", e)
+	}
+}
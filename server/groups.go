@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// Besides client ids, the device could address a frame (with the high
+// 32 bits of T) to all the clients or to a group of them:
+//
+//	0xffffffff:              broadcast
+//	0xfffffffe:              the server itself, see ServerAddress
+//	0xffff0000 | group id:   the clients in the group
+//
+// Client ids in this range are never assigned.
+const (
+	BroadcastAddress uint32 = 0xffffffff
+	groupBase        uint32 = 0xffff0000
+	maxGroupId       uint32 = 0xfffd
+)
+
+// GroupAddress returns the address of the group id.
+func GroupAddress(id uint32) uint32 {
+	return groupBase | id
+}
+
+func isMulticast(id uint32) bool {
+	return id&groupBase == groupBase
+}
+
+// Group is a set of registered clients, those with all the labels or one
+// of the names.
+type Group struct {
+	Id     uint32            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Names  []string          `json:"names,omitempty"`
+}
+
+func (g *Group) Match(reg Registration) bool {
+	for _, name := range g.Names {
+		if name == reg.Name {
+			return true
+		}
+	}
+	if len(g.Labels) == 0 {
+		return false
+	}
+	for k, v := range g.Labels {
+		if reg.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Groups is the groups config by name, loaded from a json file like:
+//
+//	{
+//		"lane3": {"id": 3, "labels": {"lane": "3"}},
+//		"checkout": {"id": 4, "names": ["checkout-ui", "checkout-printer"]}
+//	}
+type Groups map[string]*Group
+
+func ParseGroups(data []byte) (Groups, error) {
+	var gs Groups
+	if err := json.Unmarshal(data, &gs); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[uint32]string)
+	for name, g := range gs {
+		if g == nil || g.Id > maxGroupId {
+			return nil, fmt.Errorf("group %q: id should be in [0, %#x]", name, maxGroupId)
+		}
+		if other, ok := ids[g.Id]; ok {
+			return nil, fmt.Errorf("group %q and %q have the same id %d", name, other, g.Id)
+		}
+		ids[g.Id] = name
+	}
+	return gs, nil
+}
+
+func (gs Groups) byAddress(addr uint32) (string, *Group) {
+	for name, g := range gs {
+		if GroupAddress(g.Id) == addr {
+			return name, g
+		}
+	}
+	return "", nil
+}
+
+// SetGroups replaces the groups config.
+func (s *Server) SetGroups(gs Groups) {
+	s.groupsMu.Lock()
+	s.groups = gs
+	s.groupsMu.Unlock()
+}
+
+func (s *Server) inGroup(g *Group, id uint32) bool {
+	e, ok := s.registry.lookup(id)
+	return ok && g.Match(e.Registration)
+}
+
+// group returns the group of name.
+func (s *Server) group(name string) *Group {
+	s.groupsMu.RLock()
+	defer s.groupsMu.RUnlock()
+
+	return s.groups[name]
+}
+
+// fanout writes tlv to all the clients matched, and returns the number of them.
+func (s *Server) fanout(match func(id uint32) bool, tlv util.TLV, to string) int {
+	n := 0
+	s.clients.Range(func(k, v interface{}) bool {
+		id := k.(uint32)
+		if !match(id) {
+			return true
+		}
+		n++
+		if err := s.writeClient(id, v.(*client.Client), tlv); err != nil {
+			s.log.client.Warn("forwarding failed", "client", id, "to", to, "err", err)
+		}
+		return true
+	})
+	return n
+}
+
+// multicast forwards tlv to all the clients addressed by addr.
+func (s *Server) multicast(addr uint32, tlv util.TLV) {
+	match := func(uint32) bool { return true }
+	to := "broadcast"
+	if addr != BroadcastAddress {
+		s.groupsMu.RLock()
+		name, g := s.groups.byAddress(addr)
+		s.groupsMu.RUnlock()
+		if g == nil {
+			s.log.conn.Warn("group doesn't exist, skip forwarding", "address", fmt.Sprintf("%#x", addr), "tlv", tlv)
+			return
+		}
+		match = func(id uint32) bool { return s.inGroup(g, id) }
+		to = fmt.Sprintf("group %q", name)
+	}
+
+	n := s.fanout(match, tlv, to)
+	s.log.conn.Debug("forward to clients", "tlv", tlv, "clients", n, "to", to)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestParseGroups(t *testing.T) {
+	for name, c := range map[string]struct {
+		data      string
+		expectErr bool
+	}{
+		"normal":     {data: `{"a": {"id": 1, "labels": {"lane": "3"}}, "b": {"id": 2, "names": ["ui"]}}`},
+		"sameId":     {data: `{"a": {"id": 1}, "b": {"id": 1}}`, expectErr: true},
+		"idTooLarge": {data: `{"a": {"id": 65534}}`, expectErr: true},
+		"malform":    {data: `[]`, expectErr: true},
+	} {
+		if _, err := ParseGroups([]byte(c.data)); (err != nil) != c.expectErr {
+			t.Errorf("%s: expect error %v, but got %v", name, c.expectErr, err)
+		}
+	}
+
+	g := &Group{Labels: map[string]string{"lane": "3"}, Names: []string{"ui"}}
+	for _, c := range []struct {
+		reg    Registration
+		expect bool
+	}{
+		{reg: Registration{Name: "ui"}, expect: true},
+		{reg: Registration{Name: "a", Labels: map[string]string{"lane": "3", "x": "y"}}, expect: true},
+		{reg: Registration{Name: "b", Labels: map[string]string{"lane": "4"}}, expect: false},
+		{reg: Registration{Name: "c"}, expect: false},
+	} {
+		if got := g.Match(c.reg); got != c.expect {
+			t.Errorf("expect %v for %+v, but got %v", c.expect, c.reg, got)
+		}
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	gs, err := ParseGroups([]byte(`{"lane3": {"id": 3, "labels": {"lane": "3"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetGroups(gs)
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	var ends []io.ReadWriteCloser
+	for i, lane := range []string{"3", "3", "4"} {
+		clientEnd, err := createClientEnd(s, 400+i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clientEnd.Close()
+		register(t, clientEnd, Registration{Name: string('a' + rune(i)), Labels: map[string]string{"lane": lane}})
+		ends = append(ends, clientEnd)
+	}
+
+	expect := util.TLV{T: uint64(TypeScanCode), L: 1, V: []byte{1}}
+	// pipes are synchronous, read them concurrently
+	receive := func(ends ...io.ReadWriteCloser) {
+		errs := make(chan error, len(ends))
+		for _, end := range ends {
+			go func(end io.ReadWriteCloser) {
+				got, err := util.ReadTLV(end)
+				if err == nil && !reflect.DeepEqual(got, expect) {
+					err = fmt.Errorf("expect %v, but got %v", expect, got)
+				}
+				errs <- err
+			}(end)
+		}
+		for range ends {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// group, the third one shouldn't receive
+	err = util.WriteTLV(serverEnd, util.TLV{T: uint64(GroupAddress(3))<<32 | expect.T, L: expect.L, V: expect.V})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(ends[0], ends[1])
+
+	// broadcast
+	err = util.WriteTLV(serverEnd, util.TLV{T: uint64(BroadcastAddress)<<32 | expect.T, L: expect.L, V: expect.V})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(ends...)
+
+	if !s.idInUse(BroadcastAddress) || !s.idInUse(GroupAddress(1)) {
+		t.Error("multicast addresses should never be assigned")
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// The server pings the device and the idle clients with TypePing every
+// interval, the peers should echo it back as it is:
+//
+//	server: TypePing {"heartbeat": 1}
+//	peer:   TypePing {"heartbeat": 1}
+//
+// The ones to the device are addressed to ServerAddress. Any frame from
+// a peer proves it's alive, the ones missed maxMissed pings in a row are
+// closed.
+const ServerAddress uint32 = 0xfffffffe
+
+// Health is the liveness of a peer.
+type Health struct {
+	LastSeen time.Time     `json:"lastSeen"`
+	RTT      time.Duration `json:"rtt"`
+	Missed   int           `json:"missed"`
+}
+
+type heartbeat struct {
+	Heartbeat uint64 `json:"heartbeat"`
+}
+
+type peerHealth struct {
+	mu sync.Mutex
+	Health
+	seq uint64
+	// the ping in flight, nil if none
+	ping   []byte
+	sentAt time.Time
+	// a ping is being written to the client
+	writing atomic.Bool
+}
+
+func newPeerHealth() *peerHealth {
+	return &peerHealth{Health: Health{LastSeen: time.Now()}}
+}
+
+func (h *peerHealth) seen() {
+	h.mu.Lock()
+	h.LastSeen = time.Now()
+	h.Missed = 0
+	h.mu.Unlock()
+}
+
+func (h *peerHealth) idle(d time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.ping != nil || time.Since(h.LastSeen) >= d
+}
+
+// nextPing returns the payload of a new ping, and whether the peer
+// is dead as it misses maxMissed pings already.
+func (h *peerHealth) nextPing(maxMissed int) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.ping != nil {
+		h.Missed++
+		if h.Missed >= maxMissed {
+			return nil, true
+		}
+	}
+	h.seq++
+	h.ping, _ = json.Marshal(heartbeat{Heartbeat: h.seq})
+	h.sentAt = time.Now()
+	return h.ping, false
+}
+
+// pong reports whether v answers the ping in flight.
+func (h *peerHealth) pong(v []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.ping == nil || !bytes.Equal(v, h.ping) {
+		return false
+	}
+	h.RTT = time.Since(h.sentAt)
+	h.ping = nil
+	return true
+}
+
+func (h *peerHealth) get() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.Health
+}
+
+func (s *Server) heartbeat() {
+	ticker := time.NewTicker(s.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.exit:
+			return
+		}
+
+		s.connMu.RLock()
+		conn := s.conn
+		s.connMu.RUnlock()
+		if conn != nil {
+			s.pingDevice(conn)
+		}
+
+		s.health.Range(func(k, v interface{}) bool {
+			s.pingClient(k.(*client.Client), v.(*peerHealth))
+			return true
+		})
+	}
+}
+
+func (s *Server) pingDevice(conn *Connection) {
+	v, dead := conn.health.nextPing(s.config.MaxMissed)
+	if dead {
+		s.log.conn.Warn("connection misses pings, close it", "missed", s.config.MaxMissed)
+		s.transit(conn, StateGone, fmt.Sprintf("missed %d pings", s.config.MaxMissed))
+		conn.Close()
+		return
+	}
+	if missed := conn.health.get().Missed; missed > 0 {
+		s.transit(conn, StateDegraded, fmt.Sprintf("missed %d pings", missed))
+	}
+	err := conn.WriteTLV(util.TLV{T: uint64(ServerAddress)<<32 | uint64(TypePing), L: uint64(len(v)), V: v})
+	if err != nil {
+		s.log.conn.Warn("ping failed", "err", err)
+	}
+}
+
+func (s *Server) pingClient(client *client.Client, h *peerHealth) {
+	if !h.idle(s.config.PingInterval) {
+		return
+	}
+	id := client.Id()
+	v, dead := h.nextPing(s.config.MaxMissed)
+	if dead {
+		s.log.client.Warn("client misses pings, close it", "client", id, "missed", s.config.MaxMissed)
+		client.Close()
+		return
+	}
+	// don't block the others by a stuck one, nor pile up the writes to it,
+	// it's closed after missing the pings anyway
+	if !h.writing.CompareAndSwap(false, true) {
+		return
+	}
+	s.spawn(func() {
+		defer h.writing.Store(false)
+		if err := s.writeClient(id, client, util.TLV{T: uint64(TypePing), L: uint64(len(v)), V: v}); err != nil {
+			s.log.client.Warn("ping failed", "client", id, "err", err)
+		}
+	})
+}
+
+// ClientHealth is the health of a client.
+type ClientHealth struct {
+	Id uint32 `json:"id"`
+	Health
+}
+
+// ServeHealth serves the health of the device and all the clients as json.
+func (s *Server) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	var res struct {
+		Device  *Health        `json:"device"`
+		Clients []ClientHealth `json:"clients"`
+	}
+
+	s.connMu.RLock()
+	if s.conn != nil {
+		h := s.conn.health.get()
+		res.Device = &h
+	}
+	s.connMu.RUnlock()
+
+	s.health.Range(func(k, v interface{}) bool {
+		res.Clients = append(res.Clients, ClientHealth{
+			Id:     k.(*client.Client).Id(),
+			Health: v.(*peerHealth).get(),
+		})
+		return true
+	})
+	sort.Slice(res.Clients, func(i, j int) bool { return res.Clients[i].Id < res.Clients[j].Id })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		s.log.server.Error("encode health failed", "err", err)
+	}
+}
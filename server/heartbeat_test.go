@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestHeartbeat(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true, PingInterval: 10 * time.Millisecond, MaxMissed: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	// the device answers
+	answered := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			ping, err := util.ReadTLV(serverEnd)
+			if err != nil {
+				return
+			}
+			if ping.T != uint64(ServerAddress)<<32|uint64(TypePing) {
+				t.Errorf("expect a ping from server, but got %v", ping)
+				return
+			}
+			if err = util.WriteTLV(serverEnd, ping); err != nil {
+				return
+			}
+			if i == 1 {
+				close(answered)
+			}
+		}
+	}()
+	<-answered
+
+	// the client doesn't
+	clientEnd, err := createClientEnd(s, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	pings := 0
+	for {
+		tlv, err := util.ReadTLV(clientEnd)
+		if err != nil {
+			break
+		}
+		if Type(tlv.T) != TypePing {
+			t.Fatalf("expect a ping, but got %v", tlv)
+		}
+		pings++
+	}
+	if pings != 3 {
+		t.Errorf("expect closed after 3 pings, but got %d", pings)
+	}
+
+	var res struct {
+		Device  *Health        `json:"device"`
+		Clients []ClientHealth `json:"clients"`
+	}
+	w := httptest.NewRecorder()
+	s.ServeHealth(w, httptest.NewRequest("GET", "/health", nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Device == nil || res.Device.RTT <= 0 {
+		t.Errorf("expect device rtt measured, but got %+v", res.Device)
+	}
+}
+
+func TestPingStuckClient(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true, PingInterval: time.Hour, MaxMissed: 10})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	h := newPeerHealth()
+	h.LastSeen = time.Now().Add(-time.Hour)
+	// it doesn't read, so the first ping is stuck
+	for i := 0; i < 3; i++ {
+		s.pingClient(client.NewClient(c1), h)
+	}
+
+	if _, err = util.ReadTLV(c2); err != nil {
+		t.Fatal(err)
+	}
+	c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if tlv, err := util.ReadTLV(c2); err == nil {
+		t.Errorf("expect only one ping written, but got %v", tlv)
+	}
+}
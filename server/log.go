@@ -0,0 +1,26 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/tw4452852/servicemgr/logging"
+)
+
+// loggers are the loggers of the subsystems of a server. The logs about a
+// client carry its id (see logging.ClientKey), so they could be leveled
+// per client.
+type loggers struct {
+	server *slog.Logger
+	conn   *slog.Logger
+	audio  *slog.Logger
+	client *slog.Logger
+}
+
+func newLoggers(l *slog.Logger) loggers {
+	return loggers{
+		server: l.With(logging.SubsystemKey, logging.Server),
+		conn:   l.With(logging.SubsystemKey, logging.Connection),
+		audio:  l.With(logging.SubsystemKey, logging.Audio),
+		client: l.With(logging.SubsystemKey, logging.Client),
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// Clients could talk to each other through the server with TypeMessage,
+// addressing the target by id, registered name or group:
+//
+//	sender: TypeMessage {"to": 42, "data": "..."}
+//	sender: TypeMessage {"toName": "recorder", "data": "..."}
+//	sender: TypeMessage {"toGroup": "lane3", "data": "..."}
+//	target: TypeMessage {"from": 7, "fromName": "ui", "data": "..."}
+//
+// The sender gets ErrorNoSuchClient if there isn't any target.
+type message struct {
+	To       uint32 `json:"to,omitempty"`
+	ToName   string `json:"toName,omitempty"`
+	ToGroup  string `json:"toGroup,omitempty"`
+	From     uint32 `json:"from,omitempty"`
+	FromName string `json:"fromName,omitempty"`
+	Data     []byte `json:"data"`
+}
+
+// handleMessage routes the message in tlv from client to its targets.
+func (s *Server) handleMessage(client *client.Client, tlv util.TLV) {
+	id := client.Id()
+	var req message
+	if err := json.Unmarshal(tlv.V, &req); err != nil || (req.To == 0 && req.ToName == "" && req.ToGroup == "") {
+		s.log.client.Warn("invalid message", "client", id, "tlv", tlv)
+		s.responseWithType(client, ErrorInvalidData)
+		return
+	}
+
+	out := message{From: id, Data: req.Data}
+	if e, ok := s.registry.lookup(id); ok {
+		out.FromName = e.Name
+	}
+	v, err := json.Marshal(out)
+	if err != nil {
+		s.log.client.Error("marshal message failed", "client", id, "err", err)
+		s.responseWithType(client, ErrorInternal)
+		return
+	}
+	tlv = util.TLV{T: uint64(TypeMessage), L: uint64(len(v)), V: v}
+
+	if req.ToGroup != "" {
+		g := s.group(req.ToGroup)
+		n := 0
+		if g != nil {
+			n = s.fanout(func(target uint32) bool {
+				return target != id && s.inGroup(g, target)
+			}, tlv, "group "+req.ToGroup)
+		}
+		if n == 0 {
+			s.log.client.Info("no client in the group of the message", "client", id, "group", req.ToGroup)
+			s.responseWithType(client, ErrorNoSuchClient)
+		}
+		return
+	}
+
+	target := req.To
+	if req.ToName != "" {
+		e, ok := s.registry.lookupName(req.ToName)
+		if !ok || !e.Online {
+			s.log.client.Info("receiver of the message doesn't exist", "client", id, "to", req.ToName)
+			s.responseWithType(client, ErrorNoSuchClient)
+			return
+		}
+		target = e.Id
+	}
+
+	ok, err := s.forward(target, tlv)
+	if !ok {
+		s.log.client.Info("receiver of the message doesn't exist", "client", id, "to", target)
+		s.responseWithType(client, ErrorNoSuchClient)
+		return
+	}
+	if err != nil {
+		s.log.client.Warn("forwarding message failed", "client", id, "to", target, "err", err)
+		s.responseWithType(client, ErrorSend)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func messageTLV(t *testing.T, m message) util.TLV {
+	v, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return util.TLV{T: uint64(TypeMessage), L: uint64(len(v)), V: v}
+}
+
+func TestMessage(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	gs, err := ParseGroups([]byte(`{"recorders": {"id": 1, "names": ["recorder"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetGroups(gs)
+
+	ui, err := createClientEnd(s, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ui.Close()
+	register(t, ui, Registration{Name: "ui"})
+	recorder, err := createClientEnd(s, 601)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	register(t, recorder, Registration{Name: "recorder"})
+
+	expect := messageTLV(t, message{From: 600, FromName: "ui", Data: []byte("start")})
+	for name, m := range map[string]message{
+		"byId":    {To: 601, Data: []byte("start")},
+		"byName":  {ToName: "recorder", Data: []byte("start")},
+		"byGroup": {ToGroup: "recorders", Data: []byte("start")},
+	} {
+		if err = util.WriteTLV(ui, messageTLV(t, m)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := util.ReadTLV(recorder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: expect %v, but got %v", name, expect, got)
+		}
+	}
+
+	for name, c := range map[string]struct {
+		m      message
+		expect Type
+	}{
+		"noTarget":     {m: message{Data: []byte("start")}, expect: ErrorInvalidData},
+		"unknownId":    {m: message{To: 602}, expect: ErrorNoSuchClient},
+		"unknownName":  {m: message{ToName: "printer"}, expect: ErrorNoSuchClient},
+		"unknownGroup": {m: message{ToGroup: "printers"}, expect: ErrorNoSuchClient},
+	} {
+		got, err := oneShotRequest(ui, messageTLV(t, c.m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Type(got.T) != c.expect {
+			t.Errorf("%s: expect %v, but got %v", name, c.expect, got)
+		}
+	}
+}
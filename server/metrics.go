@@ -0,0 +1,306 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// The metrics are served in the prometheus text format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+const (
+	fromDevice = "from_device"
+	fromClient = "from_client"
+	toDevice   = "to_device"
+	toClient   = "to_client"
+	// the size of T and L
+	tlvHeaderSize = 16
+)
+
+// latencyBuckets are the upper bounds of the forwarding latency in seconds.
+var latencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders the label pairs (name, value, ...) like {a="1",b="2"}.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string) *counterVec {
+	return &counterVec{name: name, help: help, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(v float64, pairs ...string) {
+	key := labels(pairs...)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// deleteFirst drops the series whose first label is the pair.
+func (c *counterVec) deleteFirst(name, value string) {
+	match := labels(name, value)
+	prefix := match[:len(match)-1] + ","
+	c.mu.Lock()
+	for key := range c.values {
+		if key == match || strings.HasPrefix(key, prefix) {
+			delete(c.values, key)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	// counts of each bucket, not cumulative
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+	// label pairs of each key
+	pairs map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+		pairs:   make(map[string][]string),
+	}
+}
+
+func (h *histogramVec) observe(v float64, pairs ...string) {
+	key := labels(pairs...)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+		h.pairs[key] = pairs
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist, pairs := h.values[key], h.pairs[key]
+		var n uint64
+		for i, le := range h.buckets {
+			n += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(append(pairs[:len(pairs):len(pairs)], "le", formatFloat(le))...), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(append(pairs[:len(pairs):len(pairs)], "le", "+Inf")...), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, key, formatFloat(values[key]))
+	}
+}
+
+type metrics struct {
+	frames        *counterVec
+	bytes         *counterVec
+	clientFrames  *counterVec
+	clientBytes   *counterVec
+	forwardErrors *counterVec
+	audio         *counterVec
+	latency       *histogramVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		frames:        newCounterVec("servicemgr_frames_total", "Frames read and written by type and direction."),
+		bytes:         newCounterVec("servicemgr_bytes_total", "Bytes read and written by type and direction."),
+		clientFrames:  newCounterVec("servicemgr_client_frames_total", "Frames from and to each client."),
+		clientBytes:   newCounterVec("servicemgr_client_bytes_total", "Bytes from and to each client."),
+		forwardErrors: newCounterVec("servicemgr_forward_errors_total", "Frames not forwarded by reason."),
+		audio:         newCounterVec("servicemgr_audio_handshakes_total", "Audio handshakes with the device by result."),
+		latency:       newHistogramVec("servicemgr_forward_latency_seconds", "Time from reading a frame to forwarding it.", latencyBuckets),
+	}
+}
+
+// clientLabel is the name of client id if it's registered, or its id.
+func (s *Server) clientLabel(id uint32) string {
+	if e, ok := s.registry.lookup(id); ok {
+		return e.Name
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// countFrame counts tlv read from or written to the device or client id,
+// see writeClient for the traffic written to each client.
+func (s *Server) countFrame(direction string, id uint32, tlv util.TLV) {
+	typ := Type(tlv.T & 0x00000000ffffffff).String()
+	size := float64(tlv.L + tlvHeaderSize)
+	s.metrics.frames.add(1, "type", typ, "direction", direction)
+	s.metrics.bytes.add(size, "type", typ, "direction", direction)
+	if direction == fromClient {
+		s.metrics.clientFrames.add(1, "client", s.clientLabel(id), "direction", "in")
+		s.metrics.clientBytes.add(size, "client", s.clientLabel(id), "direction", "in")
+	}
+}
+
+// writeClient writes tlv to client id and counts it. The traffic of
+// each client is counted only while it's polled, as it's forgotten after,
+// e.g. not for the clients rejected.
+func (s *Server) writeClient(id uint32, c *client.Client, tlv util.TLV) error {
+	if err := util.WriteTLV(c, tlv); err != nil {
+		return err
+	}
+	s.countFrame(toClient, id, tlv)
+	if info, ok := s.infos.Load(c); ok {
+		info.(*clientInfo).bytesOut.Add(tlv.L + tlvHeaderSize)
+		s.metrics.clientFrames.add(1, "client", s.clientLabel(id), "direction", "out")
+		s.metrics.clientBytes.add(float64(tlv.L+tlvHeaderSize), "client", s.clientLabel(id), "direction", "out")
+	}
+	return nil
+}
+
+// forgetClient drops the traffic of client id, counted by its id before
+// it's registered and by its name after.
+func (s *Server) forgetClient(id uint32) {
+	for _, label := range []string{strconv.FormatUint(uint64(id), 10), s.clientLabel(id)} {
+		s.metrics.clientFrames.deleteFirst("client", label)
+		s.metrics.clientBytes.deleteFirst("client", label)
+	}
+}
+
+// observeLatency records the time since start to forward a frame.
+func (s *Server) observeLatency(direction string, start time.Time) {
+	s.metrics.latency.observe(time.Since(start).Seconds(), "direction", direction)
+}
+
+// WriteMetrics writes all the metrics in the prometheus text format.
+func (s *Server) WriteMetrics(w io.Writer) {
+	m := s.metrics
+	m.frames.writeTo(w)
+	m.bytes.writeTo(w)
+	m.clientFrames.writeTo(w)
+	m.clientBytes.writeTo(w)
+	m.forwardErrors.writeTo(w)
+	m.audio.writeTo(w)
+	m.latency.writeTo(w)
+
+	st := s.DeviceStatus()
+	states := make(map[string]float64)
+	for state := StateAccepting; state <= StateGone; state++ {
+		v := 0.0
+		if state == st.State {
+			v = 1
+		}
+		states[labels("state", state.String())] = v
+	}
+	writeGauge(w, "servicemgr_device_state", "Current state of the device connection.", states)
+
+	uptime := 0.0
+	s.connMu.RLock()
+	if s.conn != nil {
+		uptime = time.Since(s.conn.connectedAt).Seconds()
+	}
+	s.connMu.RUnlock()
+	writeGauge(w, "servicemgr_device_uptime_seconds", "Time since the device connected.", map[string]float64{"": uptime})
+
+	writeGauge(w, "servicemgr_clients", "Connected clients.", map[string]float64{"": float64(s.numClients())})
+
+	sessions, pending := s.sessions.depth()
+	writeGauge(w, "servicemgr_detached_sessions", "Sessions waiting for their clients to resume.", map[string]float64{"": float64(sessions)})
+	writeGauge(w, "servicemgr_queue_depth", "Frames or commands waiting in the queues.", map[string]float64{
+		labels("queue", "session"): float64(pending),
+		labels("queue", "cmd"):     float64(len(s.cmds)),
+	})
+}
+
+// ServeMetrics serves the metrics for prometheus.
+func (s *Server) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
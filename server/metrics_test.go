@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	if got, expect := labels("a", `x"y\z`, "b", "1\n"), `{a="x\"y\\z",b="1\n"}`; got != expect {
+		t.Errorf("expect %s, but got %s", expect, got)
+	}
+
+	c := newCounterVec("c_total", "A counter.")
+	c.add(1, "client", "1", "direction", "in")
+	c.add(2, "client", "1", "direction", "in")
+	c.add(1, "client", "12", "direction", "in")
+	c.deleteFirst("client", "1")
+	var b bytes.Buffer
+	c.writeTo(&b)
+	if expect := "# HELP c_total A counter.\n# TYPE c_total counter\nc_total{client=\"12\",direction=\"in\"} 1\n"; b.String() != expect {
+		t.Errorf("expect %q, but got %q", expect, b.String())
+	}
+
+	h := newHistogramVec("h_seconds", "A histogram.", []float64{1, 2})
+	h.observe(0.5, "d", "x")
+	h.observe(1.5, "d", "x")
+	h.observe(3, "d", "x")
+	b.Reset()
+	h.writeTo(&b)
+	expect := `# HELP h_seconds A histogram.
+# TYPE h_seconds histogram
+h_seconds_bucket{d="x",le="1"} 1
+h_seconds_bucket{d="x",le="2"} 2
+h_seconds_bucket{d="x",le="+Inf"} 3
+h_seconds_sum{d="x"} 5
+h_seconds_count{d="x"} 3
+`
+	if b.String() != expect {
+		t.Errorf("expect %q, but got %q", expect, b.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	clientEnd, err := createClientEnd(s, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	register(t, clientEnd, Registration{Name: "scanner"})
+
+	// client -> device -> client
+	if err = util.WriteTLV(clientEnd, util.TLV{T: uint64(TypeScanCode), L: 1, V: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	tlv, err := util.ReadTLV(serverEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = util.WriteTLV(serverEnd, tlv); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = util.ReadTLV(clientEnd); err != nil {
+		t.Fatal(err)
+	}
+	// to an unknown client
+	if err = util.WriteTLV(serverEnd, util.TLV{T: 1001<<32 | uint64(TypeScanCode)}); err != nil {
+		t.Fatal(err)
+	}
+
+	expects := []string{
+		`servicemgr_frames_total{type="TypeScanCode",direction="from_client"} 1`,
+		`servicemgr_frames_total{type="TypeScanCode",direction="from_device"} 2`,
+		`servicemgr_frames_total{type="TypeScanCode",direction="to_device"} 1`,
+		`servicemgr_frames_total{type="TypeScanCode",direction="to_client"} 1`,
+		`servicemgr_frames_total{type="TypeRegister",direction="to_client"} 1`,
+		`servicemgr_bytes_total{type="TypeScanCode",direction="from_client"} 17`,
+		`servicemgr_bytes_total{type="TypeScanCode",direction="to_device"} 17`,
+		`servicemgr_client_frames_total{client="1000",direction="in"} 1`,
+		`servicemgr_client_frames_total{client="scanner",direction="in"} 1`,
+		`servicemgr_client_frames_total{client="scanner",direction="out"} 2`,
+		`servicemgr_forward_errors_total{reason="no such client"} 1`,
+		`servicemgr_forward_latency_seconds_count{direction="from_client"} 1`,
+		`servicemgr_forward_latency_seconds_count{direction="from_device"} 1`,
+		`servicemgr_device_state{state="readyNoAudio"} 1`,
+		`servicemgr_device_state{state="ready"} 0`,
+		`servicemgr_clients 1`,
+		`servicemgr_queue_depth{queue="session"} 0`,
+	}
+	var body string
+	// the frames from the device are counted asynchronously
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		w := httptest.NewRecorder()
+		s.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		body = w.Body.String()
+		if containsAll(body, expects) || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, line := range expects {
+		if !strings.Contains(body, line) {
+			t.Errorf("expect %q in metrics:\n%s", line, body)
+		}
+	}
+}
+
+func containsAll(s string, subs []string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// For devices that can't afford TLS, the device link could be protected by
+// a pre-shared key. Both ends first prove they hold the key:
+//
+//	server: TypeHandshake nonceS
+//	device: TypeHandshake nonceD | hmac(psk, 'd' | nonceS | nonceD)
+//	server: TypeHandshake hmac(psk, 's' | nonceS | nonceD)
+//
+// Then every TLV gets a trailer of a sequence number and a truncated
+// hmac(session key, direction | seq | T | V), which is appended to V
+// (and counted in L). The sequence numbers start at 0 for each direction,
+// so any injected, dropped or replayed frame fails the verification.
+const (
+	pskNonceSize   = 16
+	pskSeqSize     = 8
+	pskMACSize     = 8
+	pskTrailerSize = pskSeqSize + pskMACSize
+
+	pskDirServer = 's'
+	pskDirDevice = 'd'
+)
+
+var (
+	handshakeErr   = errors.New("psk handshake failed")
+	frameVerifyErr = errors.New("frame verification failed")
+)
+
+type pskChannel struct {
+	key []byte
+
+	wmu  sync.Mutex
+	wdir byte
+	wseq uint64
+
+	rdir byte
+	rseq uint64
+}
+
+func pskMAC(key []byte, label byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{label})
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func newPSKChannel(psk, nonceS, nonceD []byte, server bool) *pskChannel {
+	c := &pskChannel{
+		key:  pskMAC(psk, 'k', nonceS, nonceD),
+		wdir: pskDirServer,
+		rdir: pskDirDevice,
+	}
+	if !server {
+		c.wdir, c.rdir = c.rdir, c.wdir
+	}
+	return c
+}
+
+func readHandshake(r io.Reader, size int) ([]byte, error) {
+	tlv, err := util.ReadTLV(r)
+	if err != nil {
+		return nil, err
+	}
+	if Type(tlv.T) != TypeHandshake || len(tlv.V) != size {
+		return nil, fmt.Errorf("%w: unexpected %v", handshakeErr, tlv)
+	}
+	return tlv.V, nil
+}
+
+func writeHandshake(w io.Writer, v []byte) error {
+	return util.WriteTLV(w, util.TLV{T: uint64(TypeHandshake), L: uint64(len(v)), V: v})
+}
+
+// pskServerHandshake runs the handshake as the server end.
+func pskServerHandshake(rw io.ReadWriter, psk []byte) (*pskChannel, error) {
+	nonceS := make([]byte, pskNonceSize)
+	if _, err := rand.Read(nonceS); err != nil {
+		return nil, err
+	}
+	if err := writeHandshake(rw, nonceS); err != nil {
+		return nil, err
+	}
+
+	v, err := readHandshake(rw, pskNonceSize+sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	nonceD, proof := v[:pskNonceSize], v[pskNonceSize:]
+	if !hmac.Equal(proof, pskMAC(psk, pskDirDevice, nonceS, nonceD)) {
+		return nil, fmt.Errorf("%w: device doesn't hold the key", handshakeErr)
+	}
+
+	if err = writeHandshake(rw, pskMAC(psk, pskDirServer, nonceS, nonceD)); err != nil {
+		return nil, err
+	}
+	return newPSKChannel(psk, nonceS, nonceD, true), nil
+}
+
+// pskDeviceHandshake runs the handshake as the device end.
+func pskDeviceHandshake(rw io.ReadWriter, psk []byte) (*pskChannel, error) {
+	nonceS, err := readHandshake(rw, pskNonceSize)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceD := make([]byte, pskNonceSize)
+	if _, err = rand.Read(nonceD); err != nil {
+		return nil, err
+	}
+	err = writeHandshake(rw, append(nonceD, pskMAC(psk, pskDirDevice, nonceS, nonceD)...))
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := readHandshake(rw, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(proof, pskMAC(psk, pskDirServer, nonceS, nonceD)) {
+		return nil, fmt.Errorf("%w: server doesn't hold the key", handshakeErr)
+	}
+	return newPSKChannel(psk, nonceS, nonceD, false), nil
+}
+
+// FrameChannel reads and writes the frames of a link protected by a psk.
+type FrameChannel interface {
+	WriteTLV(w io.Writer, tlv util.TLV) error
+	ReadTLV(r io.Reader) (util.TLV, error)
+}
+
+// DevicePSKHandshake runs the psk handshake as the device end of rw, and
+// returns the channel of the frames afterwards.
+func DevicePSKHandshake(rw io.ReadWriter, psk []byte) (FrameChannel, error) {
+	c, err := pskDeviceHandshake(rw, psk)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *pskChannel) mac(dir byte, seq []byte, tlv util.TLV) []byte {
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], tlv.T)
+	return pskMAC(c.key, dir, seq, t[:], tlv.V)[:pskMACSize]
+}
+
+func (c *pskChannel) WriteTLV(w io.Writer, tlv util.TLV) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var seq [pskSeqSize]byte
+	binary.BigEndian.PutUint64(seq[:], c.wseq)
+
+	v := make([]byte, 0, len(tlv.V)+pskTrailerSize)
+	v = append(v, tlv.V...)
+	v = append(v, seq[:]...)
+	v = append(v, c.mac(c.wdir, seq[:], tlv)...)
+	err := util.WriteTLV(w, util.TLV{T: tlv.T, L: uint64(len(v)), V: v})
+	if err != nil {
+		return err
+	}
+	c.wseq++
+	return nil
+}
+
+// ReadTLV isn't safe for concurrent use, there is only one reader per link.
+func (c *pskChannel) ReadTLV(r io.Reader) (util.TLV, error) {
+	tlv, err := util.ReadTLV(r)
+	if err != nil {
+		return tlv, err
+	}
+	if len(tlv.V) < pskTrailerSize {
+		return tlv, fmt.Errorf("%w: %v is too short", frameVerifyErr, tlv)
+	}
+
+	n := len(tlv.V) - pskTrailerSize
+	seq, sum := tlv.V[n:n+pskSeqSize], tlv.V[n+pskSeqSize:]
+	tlv.V, tlv.L = tlv.V[:n], uint64(n)
+	if got := binary.BigEndian.Uint64(seq); got != c.rseq {
+		return tlv, fmt.Errorf("%w: expect sequence %d, but got %d", frameVerifyErr, c.rseq, got)
+	}
+	if !hmac.Equal(sum, c.mac(c.rdir, seq, tlv)) {
+		return tlv, fmt.Errorf("%w: bad mac of %v", frameVerifyErr, tlv)
+	}
+	c.rseq++
+	return tlv, nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func pskPair(t *testing.T, serverKey, deviceKey []byte) (server, device *pskChannel, err error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		device, err = pskDeviceHandshake(c2, deviceKey)
+		if err != nil {
+			// unblock the server end
+			c2.Close()
+		}
+		done <- err
+	}()
+	server, err = pskServerHandshake(c1, serverKey)
+	if err != nil {
+		c1.Close()
+	}
+	if derr := <-done; err == nil {
+		err = derr
+	}
+	return
+}
+
+func TestPSKHandshake(t *testing.T) {
+	key := []byte("secret")
+
+	if _, _, err := pskPair(t, key, []byte("guess")); err == nil {
+		t.Fatal("handshake should fail with different keys")
+	}
+
+	server, device, err := pskPair(t, key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.key, device.key) {
+		t.Fatal("both ends should derive the same session key")
+	}
+
+	var b bytes.Buffer
+	tlvs := []util.TLV{
+		{T: 1<<32 | uint64(TypeOpenMic), L: 0, V: []byte{}},
+		{T: 1<<32 | uint64(TypeSoundData), L: 3, V: []byte{1, 2, 3}},
+	}
+	for _, tlv := range tlvs {
+		if err = server.WriteTLV(&b, tlv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := append([]byte{}, b.Bytes()...)
+	for _, expect := range tlvs {
+		got, err := device.ReadTLV(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("expect %v, but got %v", expect, got)
+		}
+	}
+
+	// replay
+	if _, err = device.ReadTLV(bytes.NewReader(frames)); !errors.Is(err, frameVerifyErr) {
+		t.Errorf("expect %v for a replayed frame, but got %v", frameVerifyErr, err)
+	}
+
+	// tamper
+	if err = device.WriteTLV(&b, tlvs[1]); err != nil {
+		t.Fatal(err)
+	}
+	tampered := b.Bytes()
+	tampered[16] ^= 0xff
+	if _, err = server.ReadTLV(&b); !errors.Is(err, frameVerifyErr) {
+		t.Errorf("expect %v for a tampered frame, but got %v", frameVerifyErr, err)
+	}
+}
+
+func TestPSKConnection(t *testing.T) {
+	key := []byte("secret")
+	s, err := newTestServer(Config{DisableAudio: true, PSK: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	serverEnd, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+	device, err := pskDeviceHandshake(serverEnd, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientEnd, err := createClientEnd(s, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+
+	// device -> client
+	err = device.WriteTLV(serverEnd, util.TLV{T: 1<<32 | uint64(TypeScanCode), L: 1, V: []byte{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := util.ReadTLV(clientEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := util.TLV{T: uint64(TypeScanCode), L: 1, V: []byte{1}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	// client -> device
+	err = util.WriteTLV(clientEnd, util.TLV{T: uint64(TypePing)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = device.ReadTLV(serverEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = util.TLV{T: 1<<32 | uint64(TypePing), V: []byte{}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	// unauthenticated frame drops the link
+	err = util.WriteTLV(serverEnd, util.TLV{T: 1<<32 | uint64(TypeScanCode), L: 1, V: []byte{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = util.ReadTLV(clientEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = util.TLV{T: uint64(ErrorConnectionGone), V: []byte{}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+	if n := s.PSKFailures(); n != 1 {
+		t.Errorf("expect 1 verification failure, but got %d", n)
+	}
+
+	// so does a device without the key
+	serverEnd2, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd2.Close()
+	if _, err = pskDeviceHandshake(serverEnd2, []byte("guess")); err == nil {
+		t.Fatal("handshake should fail with a different key")
+	}
+	for deadline := time.Now().Add(time.Second); s.PSKFailures() != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect 2 failures with the handshake, but got %d", s.PSKFailures())
+		}
+	}
+}
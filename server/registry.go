@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+)
+
+// Registration is what a client tells about itself with TypeRegister:
+//
+//	client: TypeRegister {"name": "checkout-ui", "version": "1.2.0", "labels": {"lane": "3"}}
+//	server: TypeRegister {"id": 42}
+//
+// The id is bound to the name, so a client registered with the same name
+// gets the same id after reconnecting.
+type Registration struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// RegistryEntry is a registered name and the id bound to it.
+type RegistryEntry struct {
+	Registration
+	Id       uint32    `json:"id"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+var nameInUseErr = errors.New("name is in use")
+
+type registry struct {
+	mu sync.Mutex
+	// all the names ever registered, online or not
+	names map[string]*RegistryEntry
+	// the online ones by id
+	ids map[uint32]*RegistryEntry
+	// the number of names bound to each id
+	bound map[uint32]int
+}
+
+func newRegistry() *registry {
+	return &registry{
+		names: make(map[string]*RegistryEntry),
+		ids:   make(map[uint32]*RegistryEntry),
+		bound: make(map[uint32]int),
+	}
+}
+
+// reserved reports whether id is bound to a name.
+func (r *registry) reserved(id uint32) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.bound[id] > 0
+}
+
+// bind binds e to id, r.mu is held.
+func (r *registry) bind(e *RegistryEntry, id uint32) {
+	if e.Id != 0 {
+		if r.bound[e.Id]--; r.bound[e.Id] <= 0 {
+			delete(r.bound, e.Id)
+		}
+	}
+	e.Id = id
+	r.bound[id]++
+}
+
+// lookup returns a copy of the online entry of id.
+func (r *registry) lookup(id uint32) (RegistryEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.ids[id]
+	if !ok {
+		return RegistryEntry{}, false
+	}
+	return *e, true
+}
+
+// lookupName returns a copy of the entry of name.
+func (r *registry) lookupName(name string) (RegistryEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.names[name]
+	if !ok {
+		return RegistryEntry{}, false
+	}
+	return *e, true
+}
+
+func (r *registry) offline(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.ids[id]; ok {
+		e.Online = false
+		e.LastSeen = time.Now()
+		delete(r.ids, id)
+	}
+}
+
+// List returns all the entries ordered by id.
+func (r *registry) List() []RegistryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]RegistryEntry, 0, len(r.names))
+	for _, e := range r.names {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Id < entries[j].Id })
+	return entries
+}
+
+type registerRequest struct {
+	client *client.Client
+	reg    Registration
+	// the id after registration
+	id uint32
+}
+
+// Register binds client to reg.Name and returns its id afterwards,
+// which may be different from before.
+func (s *Server) Register(client *client.Client, reg Registration) (uint32, error) {
+	req := &registerRequest{client: client, reg: reg}
+	cmd := &cmd{
+		typ:  registerClient,
+		err:  make(chan error, 1),
+		data: req,
+	}
+	select {
+	case s.cmds <- cmd:
+	case <-s.exit:
+		return 0, ErrServerClosed
+	}
+	// the loop may exit before taking it
+	select {
+	case err := <-cmd.err:
+		return req.id, err
+	case <-s.exit:
+		return 0, ErrServerClosed
+	}
+}
+
+func (s *Server) register(data interface{}) error {
+	req, ok := data.(*registerRequest)
+	if !ok || req.reg.Name == "" {
+		return dataInvalidErr
+	}
+	c, reg := req.client, req.reg
+	old := c.Id()
+	r := s.registry
+
+	r.mu.Lock()
+	e := r.names[reg.Name]
+	if e != nil && e.Online && e.Id != old {
+		owner := e.Id
+		r.mu.Unlock()
+		// the owner is away, it may never resume, so take the name over
+		if !s.dropDetached(owner) {
+			return nameInUseErr
+		}
+		s.log.client.Info("take over the name of a detached client", "client", old, "name", reg.Name, "owner", owner)
+		r.offline(owner)
+		s.subscriptions.remove(owner)
+		r.mu.Lock()
+	}
+
+	// registered with another name before
+	if prev, ok := r.ids[old]; ok && prev != e {
+		prev.Online = false
+		delete(r.ids, old)
+	}
+
+	id := old
+	if e == nil {
+		e = &RegistryEntry{}
+		r.names[reg.Name] = e
+	} else if e.Id != old {
+		// reuse the bound id unless someone else has it,
+		// otherwise bind the name to the current id
+		if _, exist := s.clients.Load(e.Id); !exist {
+			id = e.Id
+		}
+	}
+	e.Registration = reg
+	r.bind(e, id)
+	e.Online = true
+	e.LastSeen = time.Now()
+	r.ids[id] = e
+	// the sessions look the registry up under their lock, e.g. writing
+	// the frames kept, so don't hold it while rekeying them
+	r.mu.Unlock()
+
+	if id != old {
+		s.clients.Delete(old)
+		c.SetId(id)
+		s.clients.Store(id, c)
+		s.rekeySession(old, id)
+		s.subscriptions.rekey(old, id)
+	}
+	req.id = id
+	return nil
+}
+
+// ServeRegistry serves the registry as json.
+func (s *Server) ServeRegistry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.registry.List()); err != nil {
+		s.log.server.Error("encode registry failed", "err", err)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func register(t *testing.T, rw io.ReadWriter, reg Registration) (uint32, util.TLV) {
+	v, err := json.Marshal(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := oneShotRequest(rw, util.TLV{T: uint64(TypeRegister), L: uint64(len(v)), V: v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Id uint32 `json:"id"`
+	}
+	if Type(got.T) == TypeRegister {
+		if err = json.Unmarshal(got.V, &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.Id, got
+}
+
+func TestRegister(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	reg := Registration{Name: "checkout-ui", Version: "1.0", Labels: map[string]string{"lane": "3"}}
+	clientEnd, err := createClientEnd(s, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, got := register(t, clientEnd, reg)
+	if id != 100 {
+		t.Fatalf("expect id 100, but got %v", got)
+	}
+
+	// duplicate live name
+	clientEnd2, err := createClientEnd(s, 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd2.Close()
+	_, got = register(t, clientEnd2, reg)
+	if expect := (util.TLV{T: uint64(ErrorNameInUse), V: []byte{}}); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	// invalid registration
+	_, got = register(t, clientEnd2, Registration{})
+	if expect := (util.TLV{T: uint64(ErrorInvalidData), V: []byte{}}); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	// the id is reserved for the name after the client is gone
+	clientEnd.Close()
+	for {
+		if e, _ := s.registry.lookup(100); !e.Online {
+			break
+		}
+	}
+	if !s.idInUse(100) {
+		t.Fatal("id 100 should be reserved")
+	}
+
+	// reconnect with another id
+	clientEnd3, err := createClientEnd(s, 102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd3.Close()
+	id, got = register(t, clientEnd3, reg)
+	if id != 100 {
+		t.Fatalf("expect id 100 after reconnecting, but got %v", got)
+	}
+
+	// device is able to reach it with the old id
+	tlv := util.TLV{T: 100<<32 | uint64(TypeScanCode), L: 1, V: []byte{1}}
+	if err = util.WriteTLV(serverEnd, tlv); err != nil {
+		t.Fatal(err)
+	}
+	got, err = util.ReadTLV(clientEnd3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (util.TLV{T: uint64(TypeScanCode), L: 1, V: []byte{1}}); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	// device queries the registry
+	got, err = oneShotRequest(serverEnd, util.TLV{T: uint64(TypeRegister)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []RegistryEntry
+	if err = json.Unmarshal(got.V, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Id != 100 || !entries[0].Online ||
+		!reflect.DeepEqual(entries[0].Registration, reg) {
+		t.Fatalf("unexpected registry %+v", entries)
+	}
+
+	// and over http
+	w := httptest.NewRecorder()
+	s.ServeRegistry(w, httptest.NewRequest("GET", "/registry", nil))
+	entries = nil
+	if err = json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != reg.Name {
+		t.Fatalf("unexpected registry %+v", entries)
+	}
+}
+
+func TestRegisterDetached(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	reg := Registration{Name: "checkout-ui"}
+	clientEnd, err := createClientEnd(s, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(t, clientEnd, reg)
+	res, _ := resumeRequest(t, clientEnd, "")
+	clientEnd.Close()
+	waitDetached(s, 600)
+
+	// reconnect without the token
+	clientEnd, err = createClientEnd(s, 601)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	id, got := register(t, clientEnd, reg)
+	if id != 600 {
+		t.Fatalf("expect id 600 after taking the name over, but got %v", got)
+	}
+
+	// the old session is gone
+	clientEnd2, err := createClientEnd(s, 602)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd2.Close()
+	_, got = resumeRequest(t, clientEnd2, res.Token)
+	if expect := (util.TLV{T: uint64(ErrorSessionExpired), V: []byte{}}); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+}
+
+func TestRegistryBound(t *testing.T) {
+	r := newRegistry()
+	a, b := &RegistryEntry{}, &RegistryEntry{}
+	r.bind(a, 1)
+	r.bind(b, 1)
+	r.bind(a, 2)
+	if !r.reserved(1) || !r.reserved(2) {
+		t.Errorf("expect 1 and 2 bound, but got %v", r.bound)
+	}
+	r.bind(b, 3)
+	if r.reserved(1) {
+		t.Errorf("expect 1 unbound, but got %v", r.bound)
+	}
+}
+
+func TestRegisterClosed(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err = s.Register(client.NewClient(nil), Registration{Name: "ui"}); err != ErrServerClosed {
+		t.Errorf("expect %v, but got %v", ErrServerClosed, err)
+	}
+}
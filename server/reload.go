@@ -0,0 +1,96 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tw4452852/servicemgr/logging"
+)
+
+var watchInterval = 10 * time.Second
+
+// Reloader reloads its config from disk until it's closed.
+type Reloader interface {
+	Reload() error
+	String() string
+	Close()
+}
+
+func latestModTime(files []string) (t time.Time) {
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return
+}
+
+// watchReload reloads r whenever any of files is modified, until exit is closed.
+func watchReload(r Reloader, exit <-chan struct{}, files ...string) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	modTime := latestModTime(files)
+	for {
+		select {
+		case <-ticker.C:
+			t := latestModTime(files)
+			if !t.After(modTime) {
+				continue
+			}
+			modTime = t
+			if err := r.Reload(); err != nil {
+				logging.For(logging.Server).Warn("reload failed, keep the old one", "reloader", r.String(), "err", err)
+				continue
+			}
+			logging.For(logging.Server).Info("reloaded", "reloader", r.String())
+		case <-exit:
+			return
+		}
+	}
+}
+
+// FileReloader calls load with the content of a config file, at first
+// and whenever the file is modified.
+type FileReloader struct {
+	path string
+	load func(data []byte) error
+
+	exit      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewFileReloader(path string, load func(data []byte) error) (*FileReloader, error) {
+	r := &FileReloader{
+		path: path,
+		load: load,
+		exit: make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	go watchReload(r, r.exit, path)
+	return r, nil
+}
+
+func (r *FileReloader) String() string {
+	return r.path
+}
+
+func (r *FileReloader) Reload() error {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	return r.load(data)
+}
+
+// Close stops watching the file.
+func (r *FileReloader) Close() {
+	r.closeOnce.Do(func() { close(r.exit) })
+}
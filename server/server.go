@@ -0,0 +1,948 @@
+// Package server is the broker between a device and its clients.
+//
+// A device connects to the device listener and the clients to the client
+// listener, the frames (see util.TLV) from a client are forwarded to the
+// device with the client id in the high 32 bits of the type, and the ones
+// from the device are forwarded back to the client addressed.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+type cmdType int
+
+const (
+	addClient cmdType = iota
+	registerClient
+)
+
+type cmd struct {
+	typ  cmdType
+	data interface{}
+	err  chan error
+}
+
+type Server struct {
+	config Config
+	log    loggers
+
+	ln       net.Listener
+	clientLn net.Listener
+	started  atomic.Bool
+
+	connMu sync.RWMutex
+	conn   *Connection
+	// serializes installing new connections
+	installMu sync.Mutex
+	// net.Conn in handshake
+	handshakes sync.Map
+
+	// transitions of the device connections
+	history *history
+	metrics *metrics
+	taps    *taps
+	// the running or the last capture
+	recMu sync.Mutex
+	rec   *recording
+
+	clients sync.Map
+	// id -> *client.Client not visible until the handshakes complete
+	pending       sync.Map
+	registry      *registry
+	sessions      *sessions
+	subscriptions *subscriptions
+
+	groupsMu sync.RWMutex
+	groups   Groups
+
+	// *client.Client -> *peerHealth
+	health sync.Map
+	// *client.Client -> *clientInfo
+	infos sync.Map
+
+	authMu sync.RWMutex
+	auth   *Auth
+
+	pskMu sync.RWMutex
+	psk   []byte
+	// number of frames failed psk verification
+	pskFailures uint64
+
+	admissionMu sync.Mutex
+	admission   *Admission
+	nclients    int
+	// number of clients per remote ip
+	ipClients map[string]int
+
+	observersMu sync.RWMutex
+	observers   []Observer
+
+	// mic and sound opened by the clients on the device
+	streams *streams
+	// no more clients once shutdown starts
+	draining atomic.Bool
+
+	cmds      chan *cmd
+	exit      chan struct{}
+	closeOnce sync.Once
+	// all the goroutines of the server
+	wg sync.WaitGroup
+}
+
+// NewServer creates a server with c, it starts working after Serve.
+func NewServer(c Config) *Server {
+	c.setDefaults()
+	s := &Server{
+		config:        c,
+		log:           newLoggers(c.Logger),
+		cmds:          make(chan *cmd, 16),
+		exit:          make(chan struct{}),
+		ipClients:     make(map[string]int),
+		registry:      newRegistry(),
+		sessions:      newSessions(),
+		subscriptions: newSubscriptions(),
+		streams:       newStreams(),
+		history:       &history{},
+		metrics:       newMetrics(),
+		taps:          newTaps(),
+	}
+	s.SetAuth(c.Auth)
+	s.SetPSK(c.PSK)
+	s.SetAdmission(c.Admission)
+	s.SetGroups(c.Groups)
+	s.SetResumeGrace(c.ResumeGrace)
+	if c.Observer != nil {
+		s.Observe(c.Observer)
+	}
+	return s
+}
+
+// ListenAndServe listens on deviceAddr and clientAddr (empty to add clients
+// by AddClient only) with Config.Listen, then calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context, deviceAddr, clientAddr string) error {
+	deviceLn, err := s.config.Listen("tcp", deviceAddr)
+	if err != nil {
+		return err
+	}
+	var clientLn net.Listener
+	if clientAddr != "" {
+		clientLn, err = s.config.Listen("tcp", clientAddr)
+		if err != nil {
+			deviceLn.Close()
+			return err
+		}
+	}
+	return s.Serve(ctx, deviceLn, clientLn)
+}
+
+// Serve accepts devices from deviceLn and clients from clientLn (nil to
+// add clients by AddClient only) until ctx is done, then shuts down
+// within Config.ShutdownTimeout, see Shutdown. It returns
+// ErrServerClosed if the server is closed by others.
+func (s *Server) Serve(ctx context.Context, deviceLn, clientLn net.Listener) error {
+	if s.started.Swap(true) {
+		return serverStartedErr
+	}
+	s.start(deviceLn, clientLn)
+
+	select {
+	case <-ctx.Done():
+	case <-s.exit:
+		return ErrServerClosed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+func (s *Server) start(deviceLn, clientLn net.Listener) {
+	s.ln, s.clientLn = deviceLn, clientLn
+	s.spawn(s.makeConnection)
+	if clientLn != nil {
+		s.spawn(s.acceptClients)
+	}
+	s.spawn(s.loop)
+	if s.config.PingInterval > 0 {
+		s.spawn(s.heartbeat)
+	}
+}
+
+// spawn runs f in a goroutine which Close waits for.
+func (s *Server) spawn(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// Close closes the listener, the device connection and all the clients
+// at once, and waits for all the goroutines to exit. See Shutdown for
+// the graceful one.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.exit)
+
+		if s.ln != nil {
+			s.ln.Close()
+		}
+		if s.clientLn != nil {
+			s.clientLn.Close()
+		}
+
+		s.handshakes.Range(func(k, _ interface{}) bool {
+			k.(net.Conn).Close()
+			return true
+		})
+
+		s.pending.Range(func(_, v interface{}) bool {
+			v.(*client.Client).Close()
+			return true
+		})
+		s.clients.Range(func(_, v interface{}) bool {
+			client := v.(*client.Client)
+			client.Close()
+			return true
+		})
+
+		// no more connection is installed after exit
+		s.installMu.Lock()
+		s.connMu.RLock()
+		if s.conn != nil {
+			s.transit(s.conn, StateGone, ErrServerClosed.Error())
+			s.conn.Close()
+		}
+		s.connMu.RUnlock()
+		s.installMu.Unlock()
+	})
+
+	s.wg.Wait()
+	// after all the clients are gone, none is detached any more
+	s.stopSessions()
+}
+
+func (s *Server) makeConnection() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			s.log.server.Info("stop accepting devices", "err", err)
+			return
+		}
+
+		s.emitDevice(DeviceConnected, c, "", "")
+		if ip := remoteIP(c); !s.admitDevice(ip) {
+			s.log.conn.Warn("device isn't allowed, close it", "ip", ip)
+			s.emitDevice(DeviceDropped, c, "", aclDeniedErr.Error())
+			c.Close()
+			continue
+		}
+
+		// a slow device shouldn't block the others
+		s.handshakes.Store(c, struct{}{})
+		s.spawn(func() { s.handshake(c) })
+	}
+}
+
+// handshake sets up the device link on c within handshakeTimeout,
+// and makes it the current connection.
+func (s *Server) handshake(c net.Conn) {
+	defer s.handshakes.Delete(c)
+	select {
+	case <-s.exit:
+		s.emitDevice(DeviceDropped, c, "", ErrServerClosed.Error())
+		c.Close()
+		return
+	default:
+	}
+
+	s.pskMu.RLock()
+	psk := s.psk
+	s.pskMu.RUnlock()
+
+	c.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	conn, err := s.createConnection(c, psk)
+	// only the audio may fail on an established link, which is retried
+	if err != nil && !conn.Established() {
+		s.log.conn.Warn("handshake failed, close it", "remote", c.RemoteAddr(), "err", err)
+		s.emitDevice(DeviceDropped, c, conn.Identity(), err.Error())
+		s.transit(conn, StateGone, err.Error())
+		conn.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	audioFailed := err != nil
+	switch {
+	case s.config.DisableAudio:
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		s.metrics.audio.add(1, "result", "timeout")
+	case errors.Is(err, dataInvalidErr):
+		s.metrics.audio.add(1, "result", "refused")
+	case audioFailed:
+		s.metrics.audio.add(1, "result", "failed")
+	default:
+		s.metrics.audio.add(1, "result", "accepted")
+	}
+	if audioFailed {
+		s.log.audio.Warn("handshake failed", "err", err, "retry", s.config.AudioRetryInterval)
+	}
+
+	s.installMu.Lock()
+	defer s.installMu.Unlock()
+
+	select {
+	case <-s.exit:
+		s.emitDevice(DeviceDropped, c, conn.Identity(), ErrServerClosed.Error())
+		s.transit(conn, StateGone, ErrServerClosed.Error())
+		conn.Close()
+		return
+	default:
+	}
+
+	// close previous connection if any
+	s.connMu.RLock()
+	old := s.conn
+	s.connMu.RUnlock()
+	if old != nil {
+		s.log.conn.Info("replace the old connection", "old", old.RemoteAddr())
+		s.transit(old, StateGone, "replaced by a new connection")
+		old.Close()
+		<-old.done
+	}
+
+	s.log.conn.Info("connection established", "remote", c.RemoteAddr(), "device", conn.Identity())
+	s.connMu.Lock()
+	s.conn = conn
+	s.connMu.Unlock()
+	if audioFailed {
+		s.transit(conn, StateReadyNoAudio, "audio handshake failed with "+err.Error())
+	} else {
+		s.transit(conn, conn.readyState(), "handshake done")
+	}
+	s.emit(Event{Type: DeviceReady, Device: conn.Identity(), Audio: conn.AudioEnabled(), Remote: c.RemoteAddr().String()})
+	s.spawn(func() { s.pollConnection(conn) })
+	if audioFailed {
+		s.spawn(func() { s.retryAudio(conn) })
+	}
+}
+
+// retryAudio requests audio every audioRetryInterval until the device
+// accepts it, the reply is handled in pollConnection.
+func (s *Server) retryAudio(conn *Connection) {
+	ticker := time.NewTicker(s.config.AudioRetryInterval)
+	defer ticker.Stop()
+
+	for !conn.AudioEnabled() {
+		select {
+		case <-ticker.C:
+		case <-conn.done:
+			return
+		case <-s.exit:
+			return
+		}
+		if conn.AudioEnabled() {
+			return
+		}
+		if err := conn.requestAudio(); err != nil {
+			s.log.audio.Warn("request audio failed", "err", err)
+		}
+	}
+}
+
+func (s *Server) pollConnection(conn *Connection) {
+	reason := ""
+	defer func() {
+		// don't leave a half-open socket behind
+		conn.Close()
+		s.connMu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.connMu.Unlock()
+		if reason == "" {
+			reason = "closed"
+		}
+		s.transit(conn, StateGone, reason)
+		s.emitDevice(DeviceDropped, conn, conn.Identity(), reason)
+
+		// inform all clients that connection is gone
+		s.clients.Range(func(k, v interface{}) bool {
+			s.responseWithType(v.(*client.Client), ErrorConnectionGone)
+			return true
+		})
+
+		close(conn.done)
+	}()
+
+	for {
+		tlv, err := conn.ReadTLV()
+		if err == util.InternalErr {
+			s.log.conn.Error("internal error when reading, try again")
+			continue
+		}
+		if errors.Is(err, frameVerifyErr) {
+			n := atomic.AddUint64(&s.pskFailures, 1)
+			s.log.conn.Warn("verify frame failed, drop the connection", "err", err, "failures", n)
+			reason = err.Error()
+			return
+		}
+		if err != nil {
+			s.log.conn.Info("read failed, exit polling", "err", err)
+			reason = err.Error()
+			return
+		}
+
+		s.log.conn.Debug("frame received", "tlv", tlv)
+		start := time.Now()
+		s.countFrame(fromDevice, unaddressed, tlv)
+		s.tapFrame(fromDevice, uint32(tlv.T>>32), tlv)
+		conn.health.seen()
+		if st, _ := conn.State(); st == StateDegraded {
+			s.transit(conn, conn.readyState(), "device is back")
+		}
+		if uint32(tlv.T>>32) == ServerAddress {
+			if Type(tlv.T&0x00000000ffffffff) != TypePing || !conn.health.pong(tlv.V) {
+				s.log.conn.Warn("unexpected frame to server, skip it", "tlv", tlv)
+			}
+			continue
+		}
+		if Type(tlv.T&0x00000000ffffffff) == TypeRegister {
+			// the device queries the registry
+			v, err := json.Marshal(s.registry.List())
+			if err == nil {
+				err = conn.WriteTLV(util.TLV{T: tlv.T, L: uint64(len(v)), V: v})
+			}
+			if err != nil {
+				s.log.conn.Warn("reply registry failed", "err", err)
+			}
+			continue
+		}
+
+		id := uint32(tlv.T >> 32)
+
+		// clear high 32 bits
+		t := tlv.T & 0x00000000ffffffff
+		if !Type(t).IsValid() {
+			s.log.conn.Warn("invalid type, skip forwarding", "client", id, "tlv", tlv)
+			s.emitFrame(true, id, Type(t), "invalid type")
+			continue
+		}
+
+		tlv.T = t
+		if id == unaddressed && Type(t) == TypeOpenSound && !conn.AudioEnabled() {
+			// the device accepts the audio request at last
+			conn.disableAudio.Store(false)
+			s.log.audio.Info("audio is enabled")
+			s.transit(conn, StateReady, "audio accepted")
+			s.metrics.audio.add(1, "result", "accepted")
+			continue
+		}
+		if isMulticast(id) {
+			s.multicast(id, tlv)
+			s.observeLatency(fromDevice, start)
+			continue
+		}
+		if id == unaddressed {
+			s.deliver(tlv)
+			s.observeLatency(fromDevice, start)
+			continue
+		}
+
+		ok, err := s.forward(id, tlv)
+		if !ok {
+			s.log.conn.Info("client doesn't exist, skip forwarding", "client", id, "tlv", tlv)
+			s.emitFrame(true, id, Type(t), "no such client")
+			continue
+		}
+		if err != nil {
+			s.log.client.Warn("forwarding failed", "client", id, "err", err)
+			s.emitFrame(true, id, Type(t), "send failed")
+			continue
+		}
+		s.observeLatency(fromDevice, start)
+	}
+}
+
+// ErrServerClosed is returned after the server is closed.
+var ErrServerClosed = errors.New("server is closed")
+
+var (
+	dataInvalidErr    = errors.New("data invalid")
+	aclDeniedErr      = errors.New("denied by acl")
+	serverStartedErr  = errors.New("server is started already")
+	tooManyClientsErr = errors.New("too many clients")
+)
+
+func (s *Server) loop() {
+	for {
+		select {
+		case cmd := <-s.cmds:
+			switch cmd.typ {
+			case addClient:
+				cmd.err <- s.addClient(cmd.data)
+			case registerClient:
+				cmd.err <- s.register(cmd.data)
+			default:
+				s.log.server.Error("unknown cmd", "type", cmd.typ)
+			}
+		case <-s.exit:
+			return
+		}
+	}
+}
+
+// acceptClients adds the clients from the client listener.
+func (s *Server) acceptClients() {
+	for {
+		conn, err := s.clientLn.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.log.server.Warn("accept client failed", "err", err)
+			continue
+		}
+		err = s.AddClient(client.NewClient(MakeKeepAlive(conn)))
+		if err != nil {
+			s.log.server.Warn("add client failed", "err", err)
+			continue
+		}
+	}
+}
+
+func (s *Server) AddClient(client *client.Client) error {
+	cmd := &cmd{
+		typ:  addClient,
+		err:  make(chan error, 1),
+		data: client,
+	}
+	select {
+	case s.cmds <- cmd:
+	case <-s.exit:
+		return ErrServerClosed
+	}
+	// the loop may exit before taking it
+	select {
+	case err := <-cmd.err:
+		return err
+	case <-s.exit:
+		return ErrServerClosed
+	}
+}
+
+// SetPSK requires devices to authenticate with the pre-shared key psk,
+// or disables it if psk is empty. It only affects devices connected afterwards.
+func (s *Server) SetPSK(psk []byte) {
+	s.pskMu.Lock()
+	s.psk = psk
+	s.pskMu.Unlock()
+}
+
+// PSKFailures returns the number of psk handshakes and frames failed
+// verification.
+func (s *Server) PSKFailures() uint64 {
+	return atomic.LoadUint64(&s.pskFailures)
+}
+
+// SetAdmission replaces the admission config, or disables admission
+// control if a is nil. It only affects connections accepted afterwards.
+func (s *Server) SetAdmission(a *Admission) {
+	s.admissionMu.Lock()
+	s.admission = a
+	s.admissionMu.Unlock()
+}
+
+func (s *Server) admitDevice(ip net.IP) bool {
+	s.admissionMu.Lock()
+	defer s.admissionMu.Unlock()
+
+	return s.admission == nil || ip == nil || s.admission.Server.Permit(ip)
+}
+
+// admitClient accounts a new client from ip if it's admitted,
+// which should be released by releaseClient later.
+func (s *Server) admitClient(ip net.IP) error {
+	s.admissionMu.Lock()
+	defer s.admissionMu.Unlock()
+
+	if a := s.admission; a != nil {
+		if ip != nil && !a.Client.Permit(ip) {
+			return aclDeniedErr
+		}
+		if a.MaxClients > 0 && s.nclients >= a.MaxClients {
+			return tooManyClientsErr
+		}
+		if ip != nil && a.MaxClientsPerIP > 0 && s.ipClients[ip.String()] >= a.MaxClientsPerIP {
+			return tooManyClientsErr
+		}
+	}
+
+	s.nclients++
+	if ip != nil {
+		s.ipClients[ip.String()]++
+	}
+	return nil
+}
+
+func (s *Server) releaseClient(ip net.IP) {
+	s.admissionMu.Lock()
+	defer s.admissionMu.Unlock()
+
+	s.nclients--
+	if ip == nil {
+		return
+	}
+	if s.ipClients[ip.String()]--; s.ipClients[ip.String()] <= 0 {
+		delete(s.ipClients, ip.String())
+	}
+}
+
+// SetAuth enables client authentication with a, or disables it if a is nil.
+// It only affects clients connected afterwards.
+func (s *Server) SetAuth(a *Auth) {
+	s.authMu.Lock()
+	s.auth = a
+	s.authMu.Unlock()
+}
+
+func (s *Server) authenticate(client *client.Client, peer string) (*Identity, error) {
+	s.authMu.RLock()
+	a := s.auth
+	s.authMu.RUnlock()
+	if a == nil {
+		return nil, nil
+	}
+	return a.Authenticate(client, peer)
+}
+
+func (s *Server) addClient(data interface{}) error {
+	client, ok := data.(*client.Client)
+	if !ok {
+		return dataInvalidErr
+	}
+
+	id := client.Id()
+	if v, exist := s.clients.Load(id); exist && v == client {
+		return fmt.Errorf("client id[%d] already exist", id)
+	}
+	if s.idInUse(id) {
+		// the id counter wraps around, find a free one
+		id = s.freeId()
+		client.SetId(id)
+	}
+
+	if s.draining.Load() {
+		s.emitClient(ClientRejected, id, remoteIP(client.ReadWriteCloser), ErrServerClosed.Error())
+		s.spawn(func() {
+			s.responseWithType(client, ErrorServerShutdown)
+			client.Close()
+		})
+		return ErrServerClosed
+	}
+
+	ip := remoteIP(client.ReadWriteCloser)
+	if err := s.admitClient(ip); err != nil {
+		s.log.client.Warn("client isn't admitted", "client", id, "ip", ip, "err", err)
+		s.emitClient(ClientRejected, id, ip, err.Error())
+		s.spawn(func() {
+			if err == tooManyClientsErr {
+				s.responseWithType(client, ErrorTooManyClients)
+			}
+			client.Close()
+		})
+		return err
+	}
+
+	// the id is reserved until the client is visible or gone
+	if _, exist := s.pending.LoadOrStore(id, client); exist {
+		s.releaseClient(ip)
+		return fmt.Errorf("client id[%d] already exist", id)
+	}
+	if s.needsHandshake(client) {
+		s.spawn(func() { s.setupClient(client, ip) })
+	} else {
+		s.publishClient(client, ip)
+		s.spawn(func() { s.pollClient(client, ip, nil) })
+	}
+	select {
+	case <-s.exit:
+		// Close may miss it
+		client.Close()
+	default:
+	}
+	return nil
+}
+
+// idInUse reports whether id is taken by a client, bound to a registered
+// name or reserved for multicast and subscriptions.
+func (s *Server) idInUse(id uint32) bool {
+	if id == unaddressed || isMulticast(id) {
+		return true
+	}
+	_, exist := s.clients.Load(id)
+	_, pending := s.pending.Load(id)
+	return exist || pending || s.registry.reserved(id) || s.sessions.reserved(id)
+}
+
+func (s *Server) freeId() uint32 {
+	id := client.NextId()
+	for s.idInUse(id) {
+		id = client.NextId()
+	}
+	return id
+}
+
+// needsHandshake reports whether client has to finish the tls handshake
+// or the authentication before it's visible to the others.
+func (s *Server) needsHandshake(client *client.Client) bool {
+	if _, ok := client.ReadWriteCloser.(*tls.Conn); ok {
+		return true
+	}
+	s.authMu.RLock()
+	defer s.authMu.RUnlock()
+	return s.auth != nil
+}
+
+// publishClient makes the client with a reserved id visible to the
+// device and the other clients.
+func (s *Server) publishClient(client *client.Client, ip net.IP) {
+	id := client.Id()
+	s.clients.Store(id, client)
+	s.pending.Delete(id)
+	s.emitClient(ClientJoined, id, ip, "")
+}
+
+// setupClient runs the handshakes of client, and polls it once they
+// complete. The client is invisible to the device and the others until
+// then, e.g. it doesn't get the broadcasts.
+func (s *Server) setupClient(client *client.Client, ip net.IP) {
+	id := client.Id()
+	identity, err := s.handshakeClient(client)
+	if err != nil {
+		s.log.client.Warn("client handshake failed, close it", "client", id, "err", err)
+		s.emitClient(ClientRejected, id, ip, err.Error())
+		client.Close()
+		s.pending.Delete(id)
+		s.releaseClient(ip)
+		return
+	}
+	if identity != nil {
+		s.log.client.Info("authenticated", "client", id, "identity", identity.Name)
+	}
+	s.publishClient(client, ip)
+	select {
+	case <-s.exit:
+		// Close may miss it
+		client.Close()
+	default:
+	}
+	s.pollClient(client, ip, identity)
+}
+
+// handshakeClient runs the tls handshake and the authentication of
+// client, and returns the identity authenticated.
+func (s *Server) handshakeClient(client *client.Client) (*Identity, error) {
+	// a peer never finishing them shouldn't hold the slot
+	if c, ok := client.ReadWriteCloser.(net.Conn); ok {
+		c.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+		defer c.SetDeadline(time.Time{})
+	}
+
+	peer, err := PeerIdentity(client.ReadWriteCloser)
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	if peer != "" {
+		s.log.client.Info("certificate presented", "client", client.Id(), "peer", peer)
+	}
+
+	identity, err := s.authenticate(client, peer)
+	if err != nil {
+		s.responseWithType(client, ErrorPermissionDenied)
+		return nil, err
+	}
+	return identity, nil
+}
+
+// pollClient reads the frames of the visible client authenticated as
+// identity until it's gone.
+func (s *Server) pollClient(client *client.Client, ip net.IP, identity *Identity) {
+	id := client.Id()
+	s.log.client.Debug("client added", "client", id)
+
+	info := newClientInfo(client)
+	s.infos.Store(client, info)
+	defer s.infos.Delete(client)
+
+	reason := ""
+	defer func() {
+		s.log.client.Info("client exit", "client", id, "reason", reason)
+		client.Close()
+		s.clients.Delete(id)
+		s.emitClient(ClientLeft, id, ip, reason)
+		s.forgetClient(id)
+		if !info.kicked.Load() && s.detachSession(id) {
+			s.log.client.Info("keep session for resuming", "client", id)
+		} else {
+			s.dropSession(id)
+			s.registry.offline(id)
+			s.subscriptions.remove(id)
+		}
+		s.releaseClient(ip)
+	}()
+
+	h := newPeerHealth()
+	s.health.Store(client, h)
+	defer s.health.Delete(client)
+
+	for {
+		tlv, err := util.ReadTLV(client)
+		if err == util.InternalErr {
+			s.log.client.Error("internal error when reading, try again", "client", id)
+			s.responseWithType(client, ErrorInternal)
+			continue
+		}
+		if err != nil {
+			s.log.client.Info("read failed", "client", id, "err", err)
+			reason = err.Error()
+			return
+		}
+		s.log.client.Debug("frame received", "client", id, "tlv", tlv)
+		start := time.Now()
+		s.countFrame(fromClient, id, tlv)
+		s.tapFrame(fromClient, id, tlv)
+		info.read(tlv)
+		h.seen()
+		if Type(tlv.T) == TypePing && h.pong(tlv.V) {
+			continue
+		}
+
+		if !Type(tlv.T).IsValid() || Type(tlv.T) == TypeHandshake {
+			s.log.client.Warn("invalid type, skip forwarding", "client", id, "tlv", tlv)
+			s.emitFrame(false, id, Type(tlv.T), "invalid type")
+			s.responseWithType(client, ErrorInvalidType)
+			continue
+		}
+
+		if Type(tlv.T) == TypeAuth {
+			// already authenticated (or no authentication required)
+			s.responseWithType(client, TypeAuth)
+			continue
+		}
+
+		// checked against the types subscribed to
+		if Type(tlv.T) == TypeSubscribe || Type(tlv.T) == TypeUnsubscribe {
+			s.handleSubscribe(client, identity, tlv)
+			continue
+		}
+
+		if !identity.Allowed(Type(tlv.T)) {
+			s.log.client.Warn("frame denied", "client", id, "identity", identity.Name, "type", Type(tlv.T))
+			s.emitFrame(false, id, Type(tlv.T), "permission denied")
+			s.responseWithType(client, ErrorPermissionDenied)
+			continue
+		}
+
+		if Type(tlv.T) == TypeRegister {
+			id = s.handleRegister(client, tlv)
+			continue
+		}
+
+		if Type(tlv.T) == TypeStatus {
+			s.handleStatus(client)
+			continue
+		}
+
+		if Type(tlv.T) == TypeResume {
+			id = s.handleResume(client, tlv)
+			continue
+		}
+
+		if Type(tlv.T) == TypeMessage {
+			s.handleMessage(client, tlv)
+			continue
+		}
+
+		s.connMu.RLock()
+		conn := s.conn
+		s.connMu.RUnlock()
+		if conn == nil {
+			s.log.client.Info("no connection, skip forwarding", "client", id, "tlv", tlv)
+			s.emitFrame(false, id, Type(tlv.T), "no connection")
+			s.responseWithType(client, ErrorConnectionGone)
+			continue
+		}
+
+		typ := Type(tlv.T)
+		tlv.T |= uint64(id) << 32
+		err = conn.WriteTLV(tlv)
+		if err != nil {
+			s.log.conn.Warn("write failed", "client", id, "tlv", tlv, "err", err)
+			s.emitFrame(false, id, typ, "send failed")
+			s.responseWithType(client, ErrorSend)
+			continue
+		}
+		s.observeLatency(fromClient, start)
+		s.streams.update(id, typ)
+	}
+}
+
+// handleRegister registers client with the registration in tlv,
+// replies its id and returns it.
+func (s *Server) handleRegister(client *client.Client, tlv util.TLV) uint32 {
+	id := client.Id()
+	var reg Registration
+	if err := json.Unmarshal(tlv.V, &reg); err != nil || reg.Name == "" {
+		s.log.client.Warn("invalid registration", "client", id, "tlv", tlv)
+		s.responseWithType(client, ErrorInvalidData)
+		return id
+	}
+
+	newId, err := s.Register(client, reg)
+	if err == nameInUseErr {
+		s.log.client.Warn("name is in use", "client", id, "name", reg.Name)
+		s.responseWithType(client, ErrorNameInUse)
+		return id
+	}
+	if err == ErrServerClosed {
+		s.responseWithType(client, ErrorServerShutdown)
+		return id
+	}
+	if err != nil {
+		s.log.client.Error("register failed", "client", id, "name", reg.Name, "err", err)
+		s.responseWithType(client, ErrorInternal)
+		return id
+	}
+	s.log.client.Info("registered", "client", id, "name", reg.Name, "version", reg.Version, "as", newId)
+
+	v, err := json.Marshal(struct {
+		Id uint32 `json:"id"`
+	}{newId})
+	if err == nil {
+		err = s.writeClient(newId, client, util.TLV{T: uint64(TypeRegister), L: uint64(len(v)), V: v})
+	}
+	if err != nil {
+		s.log.client.Warn("reply registration failed", "client", newId, "err", err)
+	}
+	return newId
+}
+
+// helper for returning type only
+func (s *Server) responseWithType(client *client.Client, typ Type) {
+	if err := s.writeClient(client.Id(), client, util.TLV{T: uint64(typ)}); err != nil {
+		s.log.server.Warn("write type failed", "type", typ, "err", err)
+	}
+}
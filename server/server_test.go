@@ -1,23 +1,51 @@
-package main
+package server
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/logging"
 	"github.com/tw4452852/servicemgr/util"
 )
 
 func init() {
-	test = true
 	log.SetOutput(ioutil.Discard)
 }
 
+// newTestServer starts a server with c accepting devices on a random port.
+func newTestServer(c Config) (*Server, error) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	s := NewServer(c)
+	s.started.Store(true)
+	s.start(ln, nil)
+	return s, nil
+}
+
+// waitState waits for the device connection to be in state st.
+func waitState(t *testing.T, s *Server, st ConnState) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); s.DeviceStatus().State != st; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %v, but got %v", st, s.DeviceStatus().State)
+		}
+	}
+}
+
 func getConnection(s *Server) *Connection {
 	s.connMu.RLock()
 	conn := s.conn
@@ -74,13 +102,28 @@ func oneShotRequest(rw io.ReadWriter, req util.TLV) (res util.TLV, err error) {
 	return
 }
 
+// settledNumGoroutine returns the number of goroutines after the
+// short-lived ones (e.g. handshakes) exit.
+func settledNumGoroutine() int {
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+		now := runtime.NumGoroutine()
+		if now == n {
+			break
+		}
+		n = now
+	}
+	return n
+}
+
 func TestMakeConnection(t *testing.T) {
-	s, err := NewServer("notexistaddr")
-	if s != nil || err == nil {
-		t.Fatalf("NewServer should return nil server and error, but got server[%v], err[%v]", s, err)
+	err := NewServer(Config{}).ListenAndServe(context.Background(), "notexistaddr", "")
+	if err == nil {
+		t.Fatalf("ListenAndServe should fail with invalid address")
 	}
 
-	s, err = NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -101,7 +144,7 @@ func TestMakeConnection(t *testing.T) {
 	for ; oldConn == nil; oldConn = getConnection(s) {
 	}
 
-	prevNumGoRoutine := runtime.NumGoroutine()
+	prevNumGoRoutine := settledNumGoroutine()
 
 	_, err = net.Dial("tcp", serverAddr)
 	if err != nil {
@@ -112,14 +155,108 @@ func TestMakeConnection(t *testing.T) {
 	for newConn := getConnection(s); newConn == oldConn; newConn = getConnection(s) {
 	}
 
-	nowNumGoRoutine := runtime.NumGoroutine()
+	nowNumGoRoutine := settledNumGoroutine()
 	if nowNumGoRoutine != prevNumGoRoutine {
 		t.Errorf("number of goroutines not equal: previous[%d], now[%d]", prevNumGoRoutine, nowNumGoRoutine)
 	}
 }
 
+func TestHandshakeTimeout(t *testing.T) {
+	s, err := newTestServer(Config{HandshakeTimeout: 500 * time.Millisecond})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	// a device never answers the audio request
+	silent, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// it shouldn't block the next one
+	c, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tlv, err := util.ReadTLV(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Type(tlv.T) != TypeOpenSound {
+		t.Fatalf("expect audio request, but got %v", tlv)
+	}
+	// refuse audio, the link should be up anyway
+	if err = util.WriteTLV(c, util.TLV{T: uint64(ErrorInvalidData)}); err != nil {
+		t.Fatal(err)
+	}
+	var conn *Connection
+	for deadline := time.Now().Add(time.Second); conn == nil && time.Now().Before(deadline); conn = getConnection(s) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatal("connection should be established without audio")
+	}
+	if conn.AudioEnabled() {
+		t.Error("audio should be disabled")
+	}
+
+	// accept it later
+	if err = util.WriteTLV(c, util.TLV{T: uint64(TypeOpenSound)}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); !conn.AudioEnabled() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !conn.AudioEnabled() {
+		t.Error("audio should be enabled")
+	}
+
+	// the link of the silent one is up, it replaces the other without audio
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn = getConnection(s); conn != nil && conn.RemoteAddr().String() == silent.LocalAddr().String() {
+			break
+		}
+	}
+	waitState(t, s, StateReadyNoAudio)
+	if conn.RemoteAddr().String() != silent.LocalAddr().String() {
+		t.Fatalf("expect the silent device, but got %v", conn.RemoteAddr())
+	}
+	if err = util.WriteTLV(silent, util.TLV{T: uint64(TypeOpenSound)}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, StateReady)
+}
+
+func TestHandshakeTimeoutPSK(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true, PSK: []byte("secret"), HandshakeTimeout: 100 * time.Millisecond})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	// a device never finishes the psk handshake
+	silent, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// the link is dropped
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(ioutil.Discard, silent)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("silent device should be closed, but it's still open")
+	}
+	if conn := getConnection(s); conn != nil {
+		t.Errorf("expect no connection, but got %v", conn.RemoteAddr())
+	}
+}
+
 func TestAddClient(t *testing.T) {
-	s, err := NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -148,7 +285,7 @@ func TestAddClient(t *testing.T) {
 }
 
 func TestSingleDataForward(t *testing.T) {
-	s, err := NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -200,7 +337,7 @@ func TestSingleDataForward(t *testing.T) {
 }
 
 func TestMultiDataForward(t *testing.T) {
-	s, err := NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -222,16 +359,20 @@ func TestMultiDataForward(t *testing.T) {
 		ch := make(chan struct{})
 		cs = append(cs, ch)
 		go func(id int) {
+			// don't block the test if it fails
+			defer close(ch)
 			clientEnd, err := createClientEnd(s, id)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			defer clientEnd.Close()
 
 			for i := 0; i < ncount; i++ {
 				err = util.WriteTLV(clientEnd, tlv)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 			}
 
@@ -241,15 +382,14 @@ func TestMultiDataForward(t *testing.T) {
 			for i := 0; i < ncount; i++ {
 				got, err := util.ReadTLV(clientEnd)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 				if !reflect.DeepEqual(got, tlv) {
-					t.Fatalf("client %d: %d/%d msg %v != %v", id, i, ncount, got, tlv)
+					t.Errorf("client %d: %d/%d msg %v != %v", id, i, ncount, got, tlv)
+					return
 				}
 			}
-
-			// inform server
-			ch <- struct{}{}
 		}(i)
 	}
 
@@ -293,7 +433,7 @@ func TestMultiDataForward(t *testing.T) {
 }
 
 func TestConnectionNotEstablish(t *testing.T) {
-	s, err := NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -316,7 +456,7 @@ func TestConnectionNotEstablish(t *testing.T) {
 }
 
 func TestInvalidType(t *testing.T) {
-	s, err := NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -339,7 +479,7 @@ func TestInvalidType(t *testing.T) {
 }
 
 func TestInternalError(t *testing.T) {
-	s, err := NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -380,7 +520,7 @@ func TestInternalError(t *testing.T) {
 }
 
 func TestConnectionGone(t *testing.T) {
-	s, err := NewServer(":0")
+	s, err := newTestServer(Config{DisableAudio: true})
 	if s == nil || err != nil {
 		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
 	}
@@ -407,3 +547,77 @@ func TestConnectionGone(t *testing.T) {
 		t.Fatalf("expect %v, but got %v", expect, got)
 	}
 }
+
+// testLog collects the logs.
+type testLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *testLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestServe(t *testing.T) {
+	logs := &testLog{}
+	lns := make(chan net.Listener, 2)
+	s := NewServer(Config{
+		Logger:       logging.New(logs, false, logging.NewLevels(slog.LevelInfo)),
+		DisableAudio: true,
+		Listen: func(network, address string) (net.Listener, error) {
+			ln, err := net.Listen(network, address)
+			if err == nil {
+				lns <- ln
+			}
+			return ln, err
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.ListenAndServe(ctx, "127.0.0.1:0", "127.0.0.1:0")
+	}()
+	<-lns
+	clientLn := <-lns
+
+	c, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := oneShotRequest(c, util.TLV{T: uint64(TypeAuth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Type(got.T) != TypeAuth {
+		t.Fatalf("expect %v, but got %v", TypeAuth, got)
+	}
+	if err = s.Serve(ctx, clientLn, nil); err != serverStartedErr {
+		t.Errorf("expect %v for serving twice, but got %v", serverStartedErr, err)
+	}
+
+	cancel()
+	got, err = util.ReadTLV(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Type(got.T) != ErrorServerShutdown {
+		t.Fatalf("expect %v, but got %v", ErrorServerShutdown, got)
+	}
+	c.Close()
+	if err = <-done; err != nil {
+		t.Errorf("expect shutdown gracefully, but got %v", err)
+	}
+	if !strings.Contains(logs.String(), "subsystem=client") {
+		t.Errorf("expect logs of the clients, but got %q", logs.String())
+	}
+}
@@ -0,0 +1,50 @@
+// Package servertest serves a servicemgr server on the loopback for the
+// tests of the packages talking to it.
+package servertest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/server"
+)
+
+// Start serves a server with config until the test ends, and returns its
+// device and client addresses.
+func Start(t testing.TB, config server.Config) (srv *server.Server, deviceAddr, clientAddr string) {
+	t.Helper()
+	deviceLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		deviceLn.Close()
+		t.Fatal(err)
+	}
+	srv = server.NewServer(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.Serve(ctx, deviceLn, clientLn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return srv, deviceLn.Addr().String(), clientLn.Addr().String()
+}
+
+// WaitState waits a second at most for the device connection of srv to
+// be in state st.
+func WaitState(t testing.TB, srv *server.Server, st server.ConnState) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); srv.DeviceStatus().State != st; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %v, but got %v", st, srv.DeviceStatus().State)
+		}
+	}
+}
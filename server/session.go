@@ -0,0 +1,326 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// A client could ask for a resume token after connecting:
+//
+//	client: TypeResume
+//	server: TypeResume {"id": 42, "token": "..."}
+//
+// If it reconnects within the grace window after the connection drops,
+// it gets back its old id, subscriptions and the frames from the device
+// in between:
+//
+//	client: TypeResume {"token": "..."}
+//	server: TypeResume {"id": 42, "token": "..."}
+//	server: buffered frames ...
+//
+// Otherwise it gets ErrorSessionExpired.
+const maxPendingFrames = 256
+
+var sessionExpiredErr = errors.New("session expired")
+
+type session struct {
+	id    uint32
+	token string
+	// frames from the device while the client is away
+	pending []util.TLV
+	// non-nil while the client is away
+	timer *time.Timer
+}
+
+type sessions struct {
+	mu      sync.Mutex
+	grace   time.Duration
+	byToken map[string]*session
+	byId    map[uint32]*session
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		grace:   DefaultResumeGrace,
+		byToken: make(map[string]*session),
+		byId:    make(map[uint32]*session),
+	}
+}
+
+func (ss *sessions) reserved(id uint32) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	_, ok := ss.byId[id]
+	return ok
+}
+
+type resumeMessage struct {
+	Id    uint32 `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// depth returns the number of detached sessions and their pending frames.
+func (ss *sessions) depth() (n, pending int) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, sess := range ss.byId {
+		if sess.timer != nil {
+			n++
+			pending += len(sess.pending)
+		}
+	}
+	return
+}
+
+// SetResumeGrace sets how long a dropped client's session is kept.
+func (s *Server) SetResumeGrace(d time.Duration) {
+	s.sessions.mu.Lock()
+	s.sessions.grace = d
+	s.sessions.mu.Unlock()
+}
+
+// newSession returns the session of id, creates one if there isn't.
+func (s *Server) newSession(id uint32) (*session, error) {
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if sess, ok := ss.byId[id]; ok {
+		return sess, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	sess := &session{id: id, token: hex.EncodeToString(b)}
+	ss.byToken[sess.token] = sess
+	ss.byId[id] = sess
+	return sess, nil
+}
+
+// stopSessions drops all the sessions and stops their timers.
+func (s *Server) stopSessions() {
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for id, sess := range ss.byId {
+		if sess.timer != nil {
+			sess.timer.Stop()
+			sess.timer = nil
+		}
+		delete(ss.byId, id)
+		delete(ss.byToken, sess.token)
+	}
+}
+
+// detachSession keeps the session of id, if any, for the grace window.
+func (s *Server) detachSession(id uint32) bool {
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sess, ok := ss.byId[id]
+	if !ok {
+		return false
+	}
+	sess.timer = time.AfterFunc(ss.grace, func() {
+		s.expireSession(sess)
+	})
+	return true
+}
+
+// dropSession drops the session of id, if any, at once.
+func (s *Server) dropSession(id uint32) {
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if sess, ok := ss.byId[id]; ok {
+		delete(ss.byId, id)
+		delete(ss.byToken, sess.token)
+	}
+}
+
+// dropDetached drops the session of id at once if the client is away,
+// and reports whether it did. The caller takes the client offline.
+func (s *Server) dropDetached(id uint32) bool {
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sess, ok := ss.byId[id]
+	if !ok || sess.timer == nil || !sess.timer.Stop() {
+		return false
+	}
+	sess.timer = nil
+	delete(ss.byId, id)
+	delete(ss.byToken, sess.token)
+	return true
+}
+
+func (s *Server) expireSession(sess *session) {
+	ss := s.sessions
+	ss.mu.Lock()
+	if sess.timer == nil || ss.byId[sess.id] != sess {
+		// resumed already
+		ss.mu.Unlock()
+		return
+	}
+	delete(ss.byId, sess.id)
+	delete(ss.byToken, sess.token)
+	ss.mu.Unlock()
+
+	s.log.client.Info("client doesn't come back, drop the pending frames", "client", sess.id, "pending", len(sess.pending))
+	s.registry.offline(sess.id)
+	s.subscriptions.remove(sess.id)
+}
+
+// forward writes tlv to the client id or buffers it if the client is away.
+// It returns false if there is neither.
+func (s *Server) forward(id uint32, tlv util.TLV) (bool, error) {
+	if v, ok := s.clients.Load(id); ok {
+		return true, s.writeClient(id, v.(*client.Client), tlv)
+	}
+
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	// check again, the client may be resuming
+	if v, ok := s.clients.Load(id); ok {
+		return true, s.writeClient(id, v.(*client.Client), tlv)
+	}
+	sess, ok := ss.byId[id]
+	if !ok || sess.timer == nil {
+		return false, nil
+	}
+	if len(sess.pending) >= maxPendingFrames {
+		s.log.client.Warn("too many pending frames, drop the oldest", "client", id, "tlv", sess.pending[0])
+		sess.pending = sess.pending[1:]
+	}
+	sess.pending = append(sess.pending, tlv)
+	return true, nil
+}
+
+// resume moves client to the session of token, replies and flushes the
+// pending frames to it, then returns the id of the session.
+func (s *Server) resume(client *client.Client, token string) (uint32, error) {
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sess, ok := ss.byToken[token]
+	if !ok || sess.timer == nil || !sess.timer.Stop() {
+		return 0, sessionExpiredErr
+	}
+	sess.timer = nil
+
+	// it's the only one who could change its own id, and no one else takes
+	// the id of a session
+	old := client.Id()
+	if prev, ok := ss.byId[old]; ok {
+		delete(ss.byId, old)
+		delete(ss.byToken, prev.token)
+	}
+	s.clients.Delete(old)
+	client.SetId(sess.id)
+	// visible before writing, so that Close could break the writes
+	s.clients.Store(sess.id, client)
+	select {
+	case <-s.exit:
+		// Close may miss it
+		client.Close()
+	default:
+	}
+
+	err := s.writeResume(client, sess)
+	for _, tlv := range sess.pending {
+		if err != nil {
+			break
+		}
+		err = s.writeClient(sess.id, client, tlv)
+	}
+	sess.pending = nil
+	return sess.id, err
+}
+
+// rekeySession moves the session of old, if any, to id, and drops the
+// one of id it replaces.
+func (s *Server) rekeySession(old, id uint32) {
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if prev, ok := ss.byId[id]; ok {
+		if prev.timer != nil {
+			prev.timer.Stop()
+			prev.timer = nil
+		}
+		delete(ss.byId, id)
+		delete(ss.byToken, prev.token)
+	}
+	if sess, ok := ss.byId[old]; ok {
+		delete(ss.byId, old)
+		sess.id = id
+		ss.byId[id] = sess
+	}
+}
+
+func (s *Server) writeResume(client *client.Client, sess *session) error {
+	v, err := json.Marshal(resumeMessage{Id: sess.id, Token: sess.token})
+	if err != nil {
+		return err
+	}
+	return s.writeClient(sess.id, client, util.TLV{T: uint64(TypeResume), L: uint64(len(v)), V: v})
+}
+
+// handleResume issues or resumes a session for client and returns its id.
+func (s *Server) handleResume(client *client.Client, tlv util.TLV) uint32 {
+	id := client.Id()
+	var req resumeMessage
+	if len(tlv.V) != 0 {
+		if err := json.Unmarshal(tlv.V, &req); err != nil {
+			s.log.client.Warn("invalid resume request", "client", id, "tlv", tlv)
+			s.responseWithType(client, ErrorInvalidData)
+			return id
+		}
+	}
+
+	if req.Token == "" {
+		sess, err := s.newSession(id)
+		if err != nil {
+			s.log.client.Error("create session failed", "client", id, "err", err)
+			s.responseWithType(client, ErrorInternal)
+			return id
+		}
+		if err = s.writeResume(client, sess); err != nil {
+			s.log.client.Warn("reply session failed", "client", id, "err", err)
+		}
+		return id
+	}
+
+	newId, err := s.resume(client, req.Token)
+	if err == sessionExpiredErr {
+		s.log.client.Info("resume an expired session", "client", id)
+		s.responseWithType(client, ErrorSessionExpired)
+		return id
+	}
+	s.log.client.Info("session resumed", "client", id, "as", newId)
+	s.registry.offline(id)
+	s.subscriptions.remove(id)
+	if err != nil {
+		s.log.client.Warn("flush session failed", "client", newId, "err", err)
+	}
+	return newId
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func resumeRequest(t *testing.T, rw io.ReadWriter, token string) (resumeMessage, util.TLV) {
+	var req util.TLV
+	req.T = uint64(TypeResume)
+	if token != "" {
+		v, err := json.Marshal(resumeMessage{Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.L, req.V = uint64(len(v)), v
+	}
+	got, err := oneShotRequest(rw, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res resumeMessage
+	if Type(got.T) == TypeResume {
+		if err = json.Unmarshal(got.V, &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res, got
+}
+
+func waitDetached(s *Server, id uint32) {
+	for {
+		s.sessions.mu.Lock()
+		sess, ok := s.sessions.byId[id]
+		detached := ok && sess.timer != nil
+		s.sessions.mu.Unlock()
+		if detached {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResume(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	clientEnd, err := createClientEnd(s, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, got := resumeRequest(t, clientEnd, "")
+	if res.Id != 200 || res.Token == "" {
+		t.Fatalf("expect a token for client 200, but got %v", got)
+	}
+
+	// drop and the device replies in between
+	clientEnd.Close()
+	waitDetached(s, 200)
+	tlvs := []util.TLV{
+		{T: 200<<32 | uint64(TypeScanCode), L: 1, V: []byte{1}},
+		{T: 200<<32 | uint64(TypeMicData), L: 2, V: []byte{2, 3}},
+	}
+	for _, tlv := range tlvs {
+		if err = util.WriteTLV(serverEnd, tlv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clientEnd, err = createClientEnd(s, 201)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	// wait the frames are buffered
+	for {
+		s.sessions.mu.Lock()
+		n := len(s.sessions.byId[200].pending)
+		s.sessions.mu.Unlock()
+		if n == len(tlvs) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	resumed, got := resumeRequest(t, clientEnd, res.Token)
+	if !reflect.DeepEqual(resumed, res) {
+		t.Fatalf("expect %+v after resuming, but got %v", res, got)
+	}
+	for _, tlv := range tlvs {
+		got, err = util.ReadTLV(clientEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlv.T &= 0xffffffff
+		if !reflect.DeepEqual(got, tlv) {
+			t.Fatalf("expect buffered %v, but got %v", tlv, got)
+		}
+	}
+
+	// the old id works
+	err = util.WriteTLV(serverEnd, util.TLV{T: 200<<32 | uint64(TypeScanCode)})
+	if err == nil {
+		got, err = util.ReadTLV(clientEnd)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (util.TLV{T: uint64(TypeScanCode), V: []byte{}}); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+}
+
+func TestResumeExpired(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+	s.SetResumeGrace(time.Millisecond)
+
+	clientEnd, err := createClientEnd(s, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := resumeRequest(t, clientEnd, "")
+	clientEnd.Close()
+
+	// wait it expires
+	for s.idInUse(300) {
+		time.Sleep(time.Millisecond)
+	}
+
+	clientEnd, err = createClientEnd(s, 301)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	for _, token := range []string{res.Token, "guess"} {
+		_, got := resumeRequest(t, clientEnd, token)
+		if expect := (util.TLV{T: uint64(ErrorSessionExpired), V: []byte{}}); !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %v, but got %v", expect, got)
+		}
+	}
+}
+
+func TestRekeySession(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	a, err := s.newSession(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.newSession(2); err != nil {
+		t.Fatal(err)
+	}
+	s.rekeySession(1, 2)
+
+	ss := s.sessions
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.byId) != 1 || len(ss.byToken) != 1 || ss.byId[2] != a || ss.byToken[a.token] != a {
+		t.Errorf("expect only the session %+v as 2, but got %v and %v", a, ss.byId, ss.byToken)
+	}
+}
+
+func TestCloseDetached(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	clientEnd, err := createClientEnd(s, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumeRequest(t, clientEnd, "")
+	clientEnd.Close()
+	waitDetached(s, 400)
+
+	s.Close()
+	if n, _ := s.sessions.depth(); n != 0 {
+		t.Errorf("expect no session after closing, but got %d", n)
+	}
+}
+
+func TestCloseResuming(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	clientEnd, err := createClientEnd(s, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := resumeRequest(t, clientEnd, "")
+	clientEnd.Close()
+	waitDetached(s, 500)
+
+	clientEnd, err = createClientEnd(s, 501)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	// resume without reading the reply, so the server blocks on writing it
+	v, err := json.Marshal(resumeMessage{Token: res.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = util.WriteTLV(clientEnd, util.TLV{T: uint64(TypeResume), L: uint64(len(v)), V: v}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, ok := s.clients.Load(uint32(501)); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close hangs on the resuming client")
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// streams tracks the mic and sound the clients opened on the device,
+// by the client id they were opened with.
+type streams struct {
+	mu    sync.Mutex
+	mic   map[uint32]bool
+	sound map[uint32]bool
+}
+
+func newStreams() *streams {
+	return &streams{
+		mic:   make(map[uint32]bool),
+		sound: make(map[uint32]bool),
+	}
+}
+
+// update records the frame of type t sent to the device by id.
+func (ss *streams) update(id uint32, t Type) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	switch t {
+	case TypeOpenMic:
+		ss.mic[id] = true
+	case TypeCloseMic:
+		delete(ss.mic, id)
+	case TypeOpenSound:
+		ss.sound[id] = true
+	case TypeCloseSound:
+		delete(ss.sound, id)
+	}
+}
+
+// closing returns the frames to close all the opened streams.
+func (ss *streams) closing() []util.TLV {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var tlvs []util.TLV
+	add := func(m map[uint32]bool, t Type) {
+		ids := make([]uint32, 0, len(m))
+		for id := range m {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			tlvs = append(tlvs, util.TLV{T: uint64(id)<<32 | uint64(t)})
+		}
+	}
+	add(ss.mic, TypeCloseMic)
+	add(ss.sound, TypeCloseSound)
+	return tlvs
+}
+
+// closeStreams closes the mic and sound still open on the device,
+// including the sound opened by the audio handshake.
+func (s *Server) closeStreams() {
+	s.connMu.RLock()
+	conn := s.conn
+	s.connMu.RUnlock()
+	if conn == nil {
+		return
+	}
+
+	tlvs := s.streams.closing()
+	if conn.AudioEnabled() {
+		tlvs = append(tlvs, util.TLV{T: uint64(TypeCloseSound)})
+	}
+	for _, tlv := range tlvs {
+		if err := conn.WriteTLV(tlv); err != nil {
+			s.log.server.Error("close the streams failed", "tlv", tlv, "err", err)
+			return
+		}
+	}
+}
+
+// Shutdown stops the server gracefully. It stops accepting devices and
+// clients, tells each client with ErrorServerShutdown after the frames
+// already forwarded to it, then closes it. Once all the clients are told
+// or ctx is done, it closes the streams left on the device and everything
+// else like Close, including the sessions kept for resuming.
+// It returns ctx.Err() if some clients aren't told in time.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.clientLn != nil {
+		s.clientLn.Close()
+	}
+	s.draining.Store(true)
+
+	var told sync.WaitGroup
+	n := 0
+	s.clients.Range(func(_, v interface{}) bool {
+		client := v.(*client.Client)
+		n++
+		told.Add(1)
+		// a stuck client shouldn't block the others
+		s.spawn(func() {
+			defer told.Done()
+			s.responseWithType(client, ErrorServerShutdown)
+			client.Close()
+		})
+		return true
+	})
+	s.log.server.Info("tell the clients to leave", "clients", n)
+
+	done := make(chan struct{})
+	go func() {
+		told.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.log.server.Warn("clients not told in time", "clients", s.numClients(), "err", err)
+	}
+
+	s.closeStreams()
+	s.Close()
+	return err
+}
+
+func (s *Server) numClients() int {
+	n := 0
+	s.clients.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
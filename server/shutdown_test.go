@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestStreams(t *testing.T) {
+	ss := newStreams()
+	ss.update(2, TypeOpenMic)
+	ss.update(1, TypeOpenMic)
+	ss.update(1, TypeOpenSound)
+	ss.update(3, TypeOpenSound)
+	ss.update(3, TypeCloseSound)
+	ss.update(4, TypeScanCode)
+
+	expect := []util.TLV{
+		{T: 1<<32 | uint64(TypeCloseMic)},
+		{T: 2<<32 | uint64(TypeCloseMic)},
+		{T: 1<<32 | uint64(TypeCloseSound)},
+	}
+	if got := ss.closing(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect %v, but got %v", expect, got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	told, err := createClientEnd(s, 700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer told.Close()
+	stuck, err := createClientEnd(s, 701)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	detached, err := createClientEnd(s, 702)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumeRequest(t, detached, "")
+	detached.Close()
+	waitDetached(s, 702)
+
+	// open the mic
+	if err = util.WriteTLV(told, util.TLV{T: uint64(TypeOpenMic)}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := util.ReadTLV(serverEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (util.TLV{T: 700<<32 | uint64(TypeOpenMic), V: []byte{}}); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %v, but got %v", expect, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+
+	// told, then closed without leaving by itself
+	got, err = util.ReadTLV(told)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Type(got.T) != ErrorServerShutdown {
+		t.Fatalf("expect %v, but got %v", ErrorServerShutdown, got)
+	}
+	if _, err = util.ReadTLV(told); err == nil {
+		t.Error("client should be closed after told")
+	}
+
+	// no more clients
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go io.Copy(ioutil.Discard, c1)
+	if err = s.AddClient(client.NewClient(c2)); err == nil {
+		t.Error("should not add client during shutdown")
+	}
+
+	// the stuck one never reads, and is closed at last
+	if err = <-done; err != context.DeadlineExceeded {
+		t.Errorf("expect %v, but got %v", context.DeadlineExceeded, err)
+	}
+	if _, err = util.ReadTLV(stuck); err == nil {
+		t.Error("client should be closed")
+	}
+	if n, _ := s.sessions.depth(); n != 0 {
+		t.Errorf("expect the detached sessions dropped, but got %d", n)
+	}
+
+	// the device closes the mic
+	got, err = util.ReadTLV(serverEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Type(got.T&0xffffffff) != TypeCloseMic || got.T>>32 != 700 {
+		t.Errorf("expect %v of client 700, but got %v", TypeCloseMic, got)
+	}
+	if _, err = util.ReadTLV(serverEnd); err == nil {
+		t.Error("connection should be closed")
+	}
+}
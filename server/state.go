@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// ConnState is the state of a device connection. It's handshaking once
+// accepted, then ready with or without audio (ReadyNoAudio becomes Ready
+// once the device accepts audio later, and Ready becomes ReadyNoAudio if
+// the audio is turned off). It's degraded while missing pings
+// and ready again once the device is back, and it's gone at last.
+type ConnState int
+
+const (
+	StateAccepting ConnState = iota
+	StateHandshaking
+	StateReady
+	StateReadyNoAudio
+	StateDegraded
+	StateGone
+)
+
+func (st ConnState) String() string {
+	switch st {
+	case StateAccepting:
+		return "accepting"
+	case StateHandshaking:
+		return "handshaking"
+	case StateReady:
+		return "ready"
+	case StateReadyNoAudio:
+		return "readyNoAudio"
+	case StateDegraded:
+		return "degraded"
+	case StateGone:
+		return "gone"
+	default:
+		return "unknown"
+	}
+}
+
+func (st ConnState) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+func (st *ConnState) UnmarshalText(text []byte) error {
+	for v := StateAccepting; v <= StateGone; v++ {
+		if v.String() == string(text) {
+			*st = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", text)
+}
+
+var transitions = map[ConnState][]ConnState{
+	StateAccepting:    {StateHandshaking},
+	StateHandshaking:  {StateReady, StateReadyNoAudio, StateGone},
+	StateReadyNoAudio: {StateReady, StateDegraded, StateGone},
+	StateReady:        {StateReadyNoAudio, StateDegraded, StateGone},
+	StateDegraded:     {StateReady, StateReadyNoAudio, StateGone},
+}
+
+func (st ConnState) canTransit(to ConnState) bool {
+	for _, t := range transitions[st] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition is a state change of a device connection.
+type Transition struct {
+	From   ConnState `json:"from"`
+	To     ConnState `json:"to"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	Device string    `json:"device,omitempty"`
+	Remote string    `json:"remote"`
+}
+
+// stateHistorySize is the number of transitions kept.
+const stateHistorySize = 64
+
+// history is a ring buffer of the recent transitions.
+type history struct {
+	mu   sync.Mutex
+	buf  []Transition
+	next int
+}
+
+func (h *history) add(t Transition) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.buf) < stateHistorySize {
+		h.buf = append(h.buf, t)
+		return
+	}
+	h.buf[h.next] = t
+	h.next = (h.next + 1) % stateHistorySize
+}
+
+// list returns the transitions from the oldest.
+func (h *history) list() []Transition {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ts := make([]Transition, 0, len(h.buf))
+	ts = append(ts, h.buf[h.next:]...)
+	return append(ts, h.buf[:h.next]...)
+}
+
+// setState moves conn to state to, it fails if the transition isn't
+// allowed.
+func (conn *Connection) setState(to ConnState) (ConnState, bool) {
+	conn.stateMu.Lock()
+	defer conn.stateMu.Unlock()
+
+	from := conn.state
+	if !from.canTransit(to) {
+		return from, false
+	}
+	conn.state = to
+	conn.stateSince = time.Now()
+	return from, true
+}
+
+// State returns the state of conn and since when.
+func (conn *Connection) State() (ConnState, time.Time) {
+	conn.stateMu.Lock()
+	defer conn.stateMu.Unlock()
+
+	return conn.state, conn.stateSince
+}
+
+// readyState is the state of conn once it works.
+func (conn *Connection) readyState() ConnState {
+	if conn.AudioEnabled() {
+		return StateReady
+	}
+	return StateReadyNoAudio
+}
+
+// transit moves conn to state to for reason, and records it.
+func (s *Server) transit(conn *Connection, to ConnState, reason string) {
+	from, ok := conn.setState(to)
+	if !ok {
+		if from != to {
+			s.log.conn.Debug("ignore transition", "from", from, "to", to, "reason", reason)
+		}
+		return
+	}
+	s.log.conn.Info("state changed", "remote", conn.RemoteAddr(), "from", from, "to", to, "reason", reason)
+	s.history.add(Transition{
+		From:   from,
+		To:     to,
+		Reason: reason,
+		Time:   time.Now(),
+		Device: conn.Identity(),
+		Remote: conn.RemoteAddr().String(),
+	})
+}
+
+// Status is the status of the device connection.
+type Status struct {
+	State  ConnState `json:"state"`
+	Since  time.Time `json:"since"`
+	Device string    `json:"device,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	Health *Health   `json:"health,omitempty"`
+	// Audio is the audio format once the device accepts it.
+	Audio   *AudioFormat `json:"audio,omitempty"`
+	History []Transition `json:"history"`
+}
+
+// DeviceStatus returns the status of the current device connection,
+// it's accepting if there is none.
+func (s *Server) DeviceStatus() Status {
+	st := Status{State: StateAccepting, History: s.history.list()}
+
+	s.connMu.RLock()
+	conn := s.conn
+	s.connMu.RUnlock()
+	if conn != nil {
+		st.State, st.Since = conn.State()
+		st.Device = conn.Identity()
+		st.Remote = conn.RemoteAddr().String()
+		h := conn.health.get()
+		st.Health = &h
+		if conn.AudioEnabled() {
+			f := defaultAudioFormat
+			st.Audio = &f
+		}
+	} else if n := len(st.History); n > 0 {
+		st.Since = st.History[n-1].Time
+	}
+	return st
+}
+
+// handleStatus replies the device status to client.
+func (s *Server) handleStatus(client *client.Client) {
+	v, err := json.Marshal(s.DeviceStatus())
+	if err == nil {
+		err = s.writeClient(client.Id(), client, util.TLV{T: uint64(TypeStatus), L: uint64(len(v)), V: v})
+	}
+	if err != nil {
+		s.log.client.Warn("reply status failed", "client", client.Id(), "err", err)
+	}
+}
+
+// ServeStatus serves the device status as json.
+func (s *Server) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.DeviceStatus()); err != nil {
+		s.log.server.Error("encode status failed", "err", err)
+	}
+}
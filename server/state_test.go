@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestHistory(t *testing.T) {
+	var h history
+	for i := 0; i < stateHistorySize+3; i++ {
+		h.add(Transition{Reason: string(rune('a' + i%26))})
+	}
+	ts := h.list()
+	if len(ts) != stateHistorySize {
+		t.Fatalf("expect %d transitions, but got %d", stateHistorySize, len(ts))
+	}
+	if ts[0].Reason != "d" || ts[len(ts)-1].Reason != string(rune('a'+(stateHistorySize+2)%26)) {
+		t.Errorf("transitions should be from the oldest, but got %q ... %q", ts[0].Reason, ts[len(ts)-1].Reason)
+	}
+
+	if !StateHandshaking.canTransit(StateReady) || StateGone.canTransit(StateReady) || StateAccepting.canTransit(StateReady) {
+		t.Error("unexpected transitions")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if st := s.DeviceStatus(); st.State != StateAccepting || len(st.History) != 0 {
+		t.Errorf("expect accepting without history, but got %+v", st)
+	}
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientEnd, err := createClientEnd(s, 900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+
+	res, err := oneShotRequest(clientEnd, util.TLV{T: uint64(TypeStatus)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st struct {
+		State   string
+		History []struct{ From, To string }
+	}
+	if err = json.Unmarshal(res.V, &st); Type(res.T) != TypeStatus || err != nil {
+		t.Fatalf("expect status, but got %v, err[%v]", res, err)
+	}
+	if st.State != "readyNoAudio" || len(st.History) != 2 ||
+		st.History[0].From != "accepting" || st.History[1].To != "readyNoAudio" {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	serverEnd.Close()
+	// the client is told
+	if res, err = util.ReadTLV(clientEnd); err != nil || Type(res.T) != ErrorConnectionGone {
+		t.Fatalf("expect %v, but got %v, err[%v]", ErrorConnectionGone, res, err)
+	}
+	for deadline := time.Now().Add(time.Second); getConnection(s) != nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeStatus(w, httptest.NewRequest("GET", "/status", nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(st.History); st.State != "accepting" || n != 3 || st.History[n-1].To != "gone" {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/tw4452852/servicemgr/client"
+	"github.com/tw4452852/servicemgr/util"
+)
+
+// Frames from the device without a client id (the high 32 bits of T are 0)
+// are delivered to the clients subscribed to their types:
+//
+//	client: TypeSubscribe {"types": ["TypeScanCode"], "exclusive": true}
+//	server: TypeSubscribe
+//	client: TypeUnsubscribe {"types": ["TypeScanCode"]}
+//	server: TypeUnsubscribe
+//
+// If a type has an exclusive subscriber, only it gets the frames.
+// So client id 0 is never assigned.
+const unaddressed uint32 = 0
+
+var exclusiveTakenErr = errors.New("exclusive subscriber exists")
+
+type subscribeRequest struct {
+	Types     []string `json:"types"`
+	Exclusive bool     `json:"exclusive,omitempty"`
+}
+
+type subscriptions struct {
+	mu        sync.Mutex
+	byType    map[Type]map[uint32]bool
+	exclusive map[Type]uint32
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		byType:    make(map[Type]map[uint32]bool),
+		exclusive: make(map[Type]uint32),
+	}
+}
+
+func (subs *subscriptions) subscribe(id uint32, types []Type, exclusive bool) error {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	if exclusive {
+		for _, t := range types {
+			if owner, ok := subs.exclusive[t]; ok && owner != id {
+				return exclusiveTakenErr
+			}
+		}
+	}
+	for _, t := range types {
+		if subs.byType[t] == nil {
+			subs.byType[t] = make(map[uint32]bool)
+		}
+		subs.byType[t][id] = true
+		if exclusive {
+			subs.exclusive[t] = id
+		}
+	}
+	return nil
+}
+
+func (subs *subscriptions) unsubscribe(id uint32, types []Type) {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	for _, t := range types {
+		delete(subs.byType[t], id)
+		if len(subs.byType[t]) == 0 {
+			delete(subs.byType, t)
+		}
+		if owner, ok := subs.exclusive[t]; ok && owner == id {
+			delete(subs.exclusive, t)
+		}
+	}
+}
+
+// remove drops all the subscriptions of id.
+func (subs *subscriptions) remove(id uint32) {
+	subs.unsubscribe(id, subs.types(id))
+}
+
+// rekey moves all the subscriptions of old to id.
+func (subs *subscriptions) rekey(old, id uint32) {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	for t, ids := range subs.byType {
+		if ids[old] {
+			delete(ids, old)
+			ids[id] = true
+		}
+		if subs.exclusive[t] == old {
+			subs.exclusive[t] = id
+		}
+	}
+}
+
+// types returns the types id subscribes.
+func (subs *subscriptions) types(id uint32) []Type {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	var types []Type
+	for t, ids := range subs.byType {
+		if ids[id] {
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// subscribers returns the ids which should get frames of type t.
+func (subs *subscriptions) subscribers(t Type) []uint32 {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	if owner, ok := subs.exclusive[t]; ok {
+		return []uint32{owner}
+	}
+	ids := make([]uint32, 0, len(subs.byType[t]))
+	for id := range subs.byType[t] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// deliver forwards the unaddressed tlv to the subscribers of its type.
+func (s *Server) deliver(tlv util.TLV) {
+	ids := s.subscriptions.subscribers(Type(tlv.T))
+	if len(ids) == 0 {
+		s.log.conn.Debug("no subscriber, skip forwarding", "type", Type(tlv.T), "tlv", tlv)
+		return
+	}
+	for _, id := range ids {
+		ok, err := s.forward(id, tlv)
+		if !ok {
+			s.log.conn.Info("subscriber doesn't exist, skip forwarding", "client", id, "tlv", tlv)
+			continue
+		}
+		if err != nil {
+			s.log.client.Warn("forwarding to subscriber failed", "client", id, "err", err)
+		}
+	}
+}
+
+// handleSubscribe (un)subscribes client to the types in tlv.
+func (s *Server) handleSubscribe(client *client.Client, identity *Identity, tlv util.TLV) {
+	id := client.Id()
+	typ := Type(tlv.T)
+
+	var req subscribeRequest
+	if err := json.Unmarshal(tlv.V, &req); err != nil || len(req.Types) == 0 {
+		s.log.client.Warn("invalid subscription", "client", id, "tlv", tlv)
+		s.responseWithType(client, ErrorInvalidData)
+		return
+	}
+	types := make([]Type, 0, len(req.Types))
+	for _, name := range req.Types {
+		t, ok := ParseType(name)
+		if !ok {
+			s.log.client.Warn("subscribe unknown type", "client", id, "type", name)
+			s.responseWithType(client, ErrorInvalidType)
+			return
+		}
+		if typ == TypeSubscribe && !identity.Allowed(t) {
+			s.log.client.Warn("subscription denied", "client", id, "identity", identity.Name, "type", t)
+			s.responseWithType(client, ErrorPermissionDenied)
+			return
+		}
+		types = append(types, t)
+	}
+
+	if typ == TypeUnsubscribe {
+		s.subscriptions.unsubscribe(id, types)
+	} else if err := s.subscriptions.subscribe(id, types, req.Exclusive); err != nil {
+		s.log.client.Warn("subscribe failed", "client", id, "types", req.Types, "err", err)
+		s.responseWithType(client, ErrorExclusiveTaken)
+		return
+	}
+	s.log.client.Debug("subscription changed", "client", id, "request", typ, "types", req.Types)
+	s.responseWithType(client, typ)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func subscribe(t *testing.T, rw io.ReadWriter, typ Type, req subscribeRequest) util.TLV {
+	v, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := oneShotRequest(rw, util.TLV{T: uint64(typ), L: uint64(len(v)), V: v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSubscribe(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if s == nil || err != nil {
+		t.Fatalf("NewServer should return success, but got server[%v], err[%v]", s, err)
+	}
+	defer s.Close()
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+
+	c1, err := createClientEnd(s, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := createClientEnd(s, 501)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	req := subscribeRequest{Types: []string{"TypeScanCode"}}
+	for _, c := range []io.ReadWriter{c1, c2} {
+		if got := subscribe(t, c, TypeSubscribe, req); Type(got.T) != TypeSubscribe {
+			t.Fatalf("expect %v, but got %v", TypeSubscribe, got)
+		}
+	}
+	for name, c := range map[string]struct {
+		req    subscribeRequest
+		expect Type
+	}{
+		"noType":      {req: subscribeRequest{}, expect: ErrorInvalidData},
+		"unknownType": {req: subscribeRequest{Types: []string{"TypeFoo"}}, expect: ErrorInvalidType},
+	} {
+		if got := subscribe(t, c1, TypeSubscribe, c.req); Type(got.T) != c.expect {
+			t.Errorf("%s: expect %v, but got %v", name, c.expect, got)
+		}
+	}
+
+	scan := util.TLV{T: uint64(TypeScanCode), L: 1, V: []byte{1}}
+	if err = util.WriteTLV(serverEnd, scan); err != nil {
+		t.Fatal(err)
+	}
+	// pipes are synchronous, read them concurrently
+	errs := make(chan error, 2)
+	for _, c := range []io.Reader{c1, c2} {
+		go func(c io.Reader) {
+			got, err := util.ReadTLV(c)
+			if err == nil && !reflect.DeepEqual(got, scan) {
+				err = fmt.Errorf("expect %v, but got %v", scan, got)
+			}
+			errs <- err
+		}(c)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// exclusive
+	req.Exclusive = true
+	if got := subscribe(t, c2, TypeSubscribe, req); Type(got.T) != TypeSubscribe {
+		t.Fatalf("expect %v, but got %v", TypeSubscribe, got)
+	}
+	if got := subscribe(t, c1, TypeSubscribe, req); Type(got.T) != ErrorExclusiveTaken {
+		t.Fatalf("expect %v, but got %v", ErrorExclusiveTaken, got)
+	}
+	if err = util.WriteTLV(serverEnd, scan); err != nil {
+		t.Fatal(err)
+	}
+	got, err := util.ReadTLV(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, scan) {
+		t.Fatalf("expect %v, but got %v", scan, got)
+	}
+
+	// unsubscribe, then c1 is the only one
+	if got := subscribe(t, c2, TypeUnsubscribe, req); Type(got.T) != TypeUnsubscribe {
+		t.Fatalf("expect %v, but got %v", TypeUnsubscribe, got)
+	}
+	if err = util.WriteTLV(serverEnd, scan); err != nil {
+		t.Fatal(err)
+	}
+	got, err = util.ReadTLV(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, scan) {
+		t.Fatalf("expect %v, but got %v", scan, got)
+	}
+
+	// gone with the client
+	c1.Close()
+	for len(s.subscriptions.types(500)) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if ids := s.subscriptions.subscribers(TypeScanCode); len(ids) != 0 {
+		t.Errorf("expect no subscriber, but got %v", ids)
+	}
+}
+
+func TestSubscribePermission(t *testing.T) {
+	s := newAuthServer(t)
+	defer s.Close()
+
+	clientEnd, err := createClientEnd(s, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	_, err = oneShotRequest(clientEnd, authTLV(t, authRequest{Name: "kiosk", Token: "kiosk-token"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := subscribe(t, clientEnd, TypeSubscribe, subscribeRequest{Types: []string{"TypeMicData"}}); Type(got.T) != ErrorPermissionDenied {
+		t.Errorf("expect %v, but got %v", ErrorPermissionDenied, got)
+	}
+	if got := subscribe(t, clientEnd, TypeSubscribe, subscribeRequest{Types: []string{"TypeScanCode"}}); Type(got.T) != TypeSubscribe {
+		t.Errorf("expect %v, but got %v", TypeSubscribe, got)
+	}
+}
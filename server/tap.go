@@ -0,0 +1,338 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+const (
+	// tapBuffer is the number of events a tap holds before dropping.
+	tapBuffer = 256
+	// tapDataSize is the max number of bytes shown of a frame that isn't
+	// decoded.
+	tapDataSize = 64
+	// silenceLevel is the level of silence in dBFS, about the noise floor
+	// of 16 bit pcm.
+	silenceLevel = -96.0
+)
+
+// TapFilter selects the frames of a tap, zero fields match all.
+type TapFilter struct {
+	// Client is the client id the frames are from or to.
+	Client uint32
+	Types  []Type
+	// Direction is either "from_device" or "from_client".
+	Direction string
+}
+
+func (f *TapFilter) match(direction string, id uint32, t Type) bool {
+	if f.Client != 0 && f.Client != id {
+		return false
+	}
+	if f.Direction != "" && f.Direction != direction {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, typ := range f.Types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// PCMSummary summarizes the pcm of a frame.
+type PCMSummary struct {
+	Duration time.Duration `json:"duration"`
+	// RMS and Peak are the levels in dBFS.
+	RMS  float64 `json:"rms"`
+	Peak float64 `json:"peak"`
+}
+
+// TapEvent is a frame read from the device or a client.
+type TapEvent struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	// ClientId is the client the frame is from or to.
+	ClientId uint32 `json:"clientId,omitempty"`
+	Type     string `json:"type"`
+	Length   uint64 `json:"length"`
+
+	// One of the decoded forms of the value.
+	JSON json.RawMessage `json:"json,omitempty"`
+	PCM  *PCMSummary     `json:"pcm,omitempty"`
+	// Data is the hex of the value (at most 64 bytes) otherwise.
+	Data string `json:"data,omitempty"`
+}
+
+// decodeTap decodes tlv of type t read at now.
+func decodeTap(now time.Time, direction string, id uint32, t Type, tlv util.TLV) TapEvent {
+	e := TapEvent{
+		Time:      now,
+		Direction: direction,
+		ClientId:  id,
+		Type:      t.String(),
+		Length:    tlv.L,
+	}
+	switch {
+	case len(tlv.V) == 0:
+	case t == TypeMicData || t == TypeSoundData:
+		e.PCM = summarizePCM(tlv.V, defaultAudioFormat)
+	case json.Valid(tlv.V):
+		e.JSON = append(json.RawMessage(nil), tlv.V...)
+	default:
+		v := tlv.V
+		if len(v) > tapDataSize {
+			v = v[:tapDataSize]
+		}
+		e.Data = hex.EncodeToString(v)
+	}
+	return e
+}
+
+// summarizePCM summarizes v as 16 bit little endian pcm in format f.
+func summarizePCM(v []byte, f AudioFormat) *PCMSummary {
+	n := len(v) / 2
+	p := &PCMSummary{
+		Duration: time.Duration(n/f.Channel) * time.Second / time.Duration(f.Rate),
+		RMS:      silenceLevel,
+		Peak:     silenceLevel,
+	}
+	if n == 0 {
+		return p
+	}
+	var sum, peak float64
+	for i := 0; i < n; i++ {
+		x := math.Abs(float64(int16(binary.LittleEndian.Uint16(v[2*i:]))) / 32768)
+		sum += x * x
+		peak = math.Max(peak, x)
+	}
+	if sum > 0 {
+		p.RMS = math.Max(20*math.Log10(math.Sqrt(sum/float64(n))), silenceLevel)
+		p.Peak = math.Max(20*math.Log10(peak), silenceLevel)
+	}
+	return p
+}
+
+// WriteText writes e for human.
+func (e *TapEvent) WriteText(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s", e.Time.Format("15:04:05.000000"), e.Direction)
+	if e.ClientId != 0 {
+		fmt.Fprintf(&b, " client %d", e.ClientId)
+	}
+	fmt.Fprintf(&b, " %s %d bytes\n", e.Type, e.Length)
+	switch {
+	case e.JSON != nil:
+		b.WriteString("  ")
+		if json.Indent(&b, e.JSON, "  ", "  ") != nil {
+			b.Write(e.JSON)
+		}
+		b.WriteByte('\n')
+	case e.PCM != nil:
+		fmt.Fprintf(&b, "  pcm %s, rms %.1f dBFS, peak %.1f dBFS\n", e.PCM.Duration, e.PCM.RMS, e.PCM.Peak)
+	case e.Data != "":
+		fmt.Fprintf(&b, "  %s\n", e.Data)
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// tappedFrame is a frame passed to a tap as is.
+type tappedFrame struct {
+	time      time.Time
+	direction string
+	id        uint32
+	tlv       util.TLV
+}
+
+// tap gets either the events or the frames as is.
+type tap struct {
+	filter  TapFilter
+	events  chan TapEvent
+	frames  chan tappedFrame
+	dropped atomic.Uint64
+}
+
+type taps struct {
+	mu  sync.RWMutex
+	set map[*tap]struct{}
+	// the number of taps, checked before anything else
+	n atomic.Int32
+}
+
+func newTaps() *taps {
+	return &taps{set: make(map[*tap]struct{})}
+}
+
+// Tap returns the frames matching f read from now on until stop is
+// called. The frames are dropped if the events aren't received in time,
+// see the returned dropped.
+func (s *Server) Tap(f TapFilter) (events <-chan TapEvent, dropped func() uint64, stop func()) {
+	t := &tap{filter: f, events: make(chan TapEvent, tapBuffer)}
+	return t.events, t.dropped.Load, s.taps.add(t)
+}
+
+// tapFrames is Tap with the frames as is, buffering n of them.
+func (s *Server) tapFrames(f TapFilter, n int) (frames <-chan tappedFrame, dropped func() uint64, stop func()) {
+	t := &tap{filter: f, frames: make(chan tappedFrame, n)}
+	return t.frames, t.dropped.Load, s.taps.add(t)
+}
+
+// add adds t and returns the function to remove it.
+func (ts *taps) add(t *tap) (remove func()) {
+	ts.mu.Lock()
+	ts.set[t] = struct{}{}
+	ts.n.Add(1)
+	ts.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ts.mu.Lock()
+			delete(ts.set, t)
+			ts.n.Add(-1)
+			ts.mu.Unlock()
+		})
+	}
+}
+
+// tapFrame passes tlv read from the device or client id to the taps.
+func (s *Server) tapFrame(direction string, id uint32, tlv util.TLV) {
+	if s.taps.n.Load() == 0 {
+		return
+	}
+
+	now := time.Now()
+	t := Type(tlv.T & 0x00000000ffffffff)
+	var e *TapEvent
+	s.taps.mu.RLock()
+	defer s.taps.mu.RUnlock()
+	for tap := range s.taps.set {
+		if !tap.filter.match(direction, id, t) {
+			continue
+		}
+		if tap.frames != nil {
+			select {
+			case tap.frames <- tappedFrame{now, direction, id, tlv}:
+			default:
+				tap.dropped.Add(1)
+			}
+			continue
+		}
+		if e == nil {
+			v := decodeTap(now, direction, id, t, tlv)
+			e = &v
+		}
+		select {
+		case tap.events <- *e:
+		default:
+			tap.dropped.Add(1)
+		}
+	}
+}
+
+// ServeTap streams the frames until the request is done, filtered by the
+// query:
+//
+//	client=42                      the client id
+//	type=TypeScanCode,TypeMessage  the types
+//	direction=from_client          from_device or from_client
+//	format=json                    json lines instead of text
+func (s *Server) ServeTap(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseTapFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	asJSON := q.Get("format") == "json"
+
+	events, dropped, stop := s.Tap(f)
+	defer stop()
+
+	if asJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	enc := json.NewEncoder(w)
+	var reported uint64
+	for {
+		select {
+		case e := <-events:
+			err = nil
+			if n := dropped(); n != reported && !asJSON {
+				_, err = fmt.Fprintf(w, "... %d frames dropped\n", n-reported)
+				reported = n
+			}
+			if err == nil {
+				if asJSON {
+					err = enc.Encode(&e)
+				} else {
+					err = e.WriteText(w)
+				}
+			}
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.exit:
+			return
+		}
+	}
+}
+
+// parseTapFilter parses the client, type and direction in q, see ServeTap.
+func parseTapFilter(q url.Values) (TapFilter, error) {
+	var f TapFilter
+	if v := q.Get("client"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return f, errors.New("invalid client id")
+		}
+		f.Client = uint32(id)
+	}
+	if v := q.Get("type"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			t, ok := ParseType(name)
+			if !ok {
+				return f, fmt.Errorf("unknown type %q", name)
+			}
+			f.Types = append(f.Types, t)
+		}
+	}
+	switch f.Direction = q.Get("direction"); f.Direction {
+	case "", fromDevice, fromClient:
+	default:
+		return f, errors.New("invalid direction")
+	}
+	return f, nil
+}
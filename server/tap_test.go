@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tw4452852/servicemgr/util"
+)
+
+func TestDecodeTap(t *testing.T) {
+	now := time.Now()
+
+	e := decodeTap(now, fromClient, 1, TypeMessage, util.TLV{T: uint64(TypeMessage), L: 9, V: []byte(`{"a":[1]}`)})
+	var b strings.Builder
+	e.WriteText(&b)
+	expect := now.Format("15:04:05.000000") + " from_client client 1 TypeMessage 9 bytes\n  {\n    \"a\": [\n      1\n    ]\n  }\n"
+	if b.String() != expect {
+		t.Errorf("expect %q, but got %q", expect, b.String())
+	}
+
+	e = decodeTap(now, fromDevice, 0, TypeScanCode, util.TLV{T: uint64(TypeScanCode), L: 3, V: []byte{1, 2, 3}})
+	if e.Data != "010203" || e.JSON != nil || e.PCM != nil {
+		t.Errorf("expect hex data, but got %+v", e)
+	}
+
+	// 10ms of a full scale square wave
+	pcm := make([]byte, 441*4)
+	for i := 0; i < len(pcm); i += 2 {
+		v := int16(math.MaxInt16)
+		if i%4 == 0 {
+			v = math.MinInt16
+		}
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(v))
+	}
+	e = decodeTap(now, fromDevice, 2, TypeSoundData, util.TLV{T: uint64(TypeSoundData), L: uint64(len(pcm)), V: pcm})
+	if e.PCM == nil || e.PCM.Duration != 10*time.Millisecond || math.Abs(e.PCM.Peak) > 0.01 || math.Abs(e.PCM.RMS) > 0.01 {
+		t.Errorf("unexpected pcm summary %+v", e.PCM)
+	}
+	if p := summarizePCM(make([]byte, 8), defaultAudioFormat); p.RMS != silenceLevel || p.Peak != silenceLevel {
+		t.Errorf("expect %v for silence, but got %+v", silenceLevel, p)
+	}
+}
+
+func TestTap(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// nothing to do without taps
+	tlv := util.TLV{T: uint64(TypeScanCode), L: 1, V: []byte{1}}
+	if n := testing.AllocsPerRun(100, func() { s.tapFrame(fromClient, 1, tlv) }); n != 0 {
+		t.Errorf("expect no allocation without taps, but got %v", n)
+	}
+
+	serverEnd, err := createServerEnd(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverEnd.Close()
+	clientEnd, err := createClientEnd(s, 700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+
+	events, dropped, stop := s.Tap(TapFilter{Client: 700, Types: []Type{TypeScanCode}})
+	defer stop()
+	all, _, stopAll := s.Tap(TapFilter{Direction: fromDevice})
+
+	for _, v := range []util.TLV{
+		{T: uint64(TypePing)},
+		{T: uint64(TypeScanCode), L: 2, V: []byte("42")},
+	} {
+		if err = util.WriteTLV(clientEnd, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = util.ReadTLV(serverEnd); err != nil {
+		t.Fatal(err)
+	}
+	if err = util.WriteTLV(serverEnd, util.TLV{T: 700<<32 | uint64(TypeScanCode)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = util.ReadTLV(clientEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []TapEvent{
+		{Direction: fromClient, ClientId: 700, Type: "TypeScanCode", Length: 2, JSON: json.RawMessage("42")},
+		{Direction: fromDevice, ClientId: 700, Type: "TypeScanCode"},
+	} {
+		select {
+		case e := <-events:
+			if e.Direction != expect.Direction || e.ClientId != expect.ClientId || e.Type != expect.Type ||
+				e.Length != expect.Length || string(e.JSON) != string(expect.JSON) || e.Time.IsZero() {
+				t.Errorf("expect %+v, but got %+v", expect, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("wait %+v timeout", expect)
+		}
+	}
+	select {
+	case e := <-all:
+		if e.Direction != fromDevice {
+			t.Errorf("expect frames from the device only, but got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait the frame from the device timeout")
+	}
+	if dropped() != 0 {
+		t.Errorf("expect nothing dropped, but got %d", dropped())
+	}
+
+	// a slow tap doesn't block forwarding
+	stopAll()
+	for i := 0; i < tapBuffer+10; i++ {
+		s.tapFrame(fromClient, 700, tlv)
+	}
+	if dropped() != 10 {
+		t.Errorf("expect 10 dropped, but got %d", dropped())
+	}
+	stop()
+	stop()
+	if n := s.taps.n.Load(); n != 0 {
+		t.Errorf("expect no taps, but got %d", n)
+	}
+}
+
+func TestServeTap(t *testing.T) {
+	s, err := newTestServer(Config{DisableAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ts := httptest.NewServer(http.HandlerFunc(s.ServeTap))
+	defer ts.Close()
+
+	for _, q := range []string{"client=x", "type=TypeNothing", "direction=up"} {
+		res, err := http.Get(ts.URL + "?" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expect %d, but got %d", q, http.StatusBadRequest, res.StatusCode)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "?type=TypeScanCode&format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	for s.taps.n.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.tapFrame(fromClient, 3, util.TLV{T: uint64(TypePing)})
+	s.tapFrame(fromClient, 3, util.TLV{T: uint64(TypeScanCode), L: 2, V: []byte("{}")})
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e TapEvent
+	if err = json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "TypeScanCode" || e.ClientId != 3 || string(e.JSON) != "{}" {
+		t.Errorf("unexpected %+v", e)
+	}
+}
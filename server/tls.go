@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// CertReloader serves a tls config whose certificate, key and client CAs
+// are reloaded from disk, so they could be rotated without restarting.
+// Established sessions are not affected by a reload.
+type CertReloader struct {
+	certFile, keyFile, caFile string
+
+	mu     sync.RWMutex
+	config *tls.Config
+
+	exit      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCertReloader loads the certificate and key from certFile and keyFile.
+// If caFile isn't empty, peers must present a certificate signed by
+// one of the CAs in it (mutual TLS).
+func NewCertReloader(certFile, keyFile, caFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		exit:     make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	go watchReload(r, r.exit, certFile, keyFile, caFile)
+	return r, nil
+}
+
+func (r *CertReloader) String() string {
+	return r.certFile
+}
+
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in " + r.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	r.config = config
+	r.mu.Unlock()
+	return nil
+}
+
+// Close stops watching the files.
+func (r *CertReloader) Close() {
+	r.closeOnce.Do(func() { close(r.exit) })
+}
+
+// TLSConfig returns a config which always uses the latest loaded one
+// for new handshakes.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	}
+}
+
+// Listen listens on addr, with TLS if r isn't nil.
+func (r *CertReloader) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || r == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, r.TLSConfig()), nil
+}
+
+// PeerIdentity completes the TLS handshake if c is a TLS connection and
+// returns the subject of the verified peer certificate. It returns an
+// empty identity for plain connections or peers without a certificate.
+func PeerIdentity(c interface{}) (string, error) {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+	subject := state.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName, nil
+	}
+	return subject.String(), nil
+}
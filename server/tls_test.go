@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	b, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicemgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+		caFile   = filepath.Join(dir, "ca.pem")
+	)
+	ca := newTestCert(t, "ca", 1, nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "server", 2, ca).write(t, certFile, keyFile)
+	device := newTestCert(t, "device-1", 3, ca)
+
+	r, err := NewCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ln, err := r.Listen(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Config{DisableAudio: true})
+	s.started.Store(true)
+	s.start(ln, nil)
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certs,
+		})
+	}
+
+	c, err := dial(device.tlsCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// wait server accept us
+	conn := getConnection(s)
+	for ; conn == nil; conn = getConnection(s) {
+	}
+	if got := conn.Identity(); got != "device-1" {
+		t.Errorf("expect identity %q, but got %q", "device-1", got)
+	}
+	if got := c.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); got != 2 {
+		t.Errorf("expect server certificate serial 2, but got %d", got)
+	}
+
+	// rotate server certificate
+	newTestCert(t, "server", 4, ca).write(t, certFile, keyFile)
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := dial(device.tlsCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if got := c2.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); got != 4 {
+		t.Errorf("expect reloaded server certificate serial 4, but got %d", got)
+	}
+
+	// without client certificate
+	c3, err := dial()
+	if err == nil {
+		// the server's rejection may only show up on the first read
+		_, err = c3.Read(make([]byte, 1))
+		c3.Close()
+	}
+	if err == nil {
+		t.Errorf("expect handshake failure without client certificate")
+	}
+}
+
+func TestClientTLSTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicemgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, "server", 1, nil).write(t, certFile, keyFile)
+	r, err := NewCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientLn, err := r.Listen(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Config{DisableAudio: true, HandshakeTimeout: 100 * time.Millisecond})
+	s.started.Store(true)
+	s.start(ln, clientLn)
+	defer s.Close()
+
+	// never says hello
+	c, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect closed by the server, but got %v", err)
+	}
+
+	r.Close()
+	// closing twice is fine
+	r.Close()
+}
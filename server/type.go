@@ -0,0 +1,134 @@
+package server
+
+type Type uint32
+
+const (
+	TypeBegin Type = iota
+
+	TypeOpenMic      // 1
+	TypeCloseMic     // 2
+	TypeMicData      // 3
+	TypeScanCode     // 4
+	TypeOpenSound    // 5
+	TypeCloseSound   // 6
+	TypeSoundData    // 7
+	TypePing         // 8
+	TypeFileTransfer // 9
+	TypeAuth         // 10
+	TypeHandshake    // 11
+	TypeRegister     // 12
+	TypeResume       // 13
+	TypeSubscribe    // 14
+	TypeUnsubscribe  // 15
+	TypeMessage      // 16
+	TypeStatus       // 17
+
+	TypeEnd
+)
+
+const (
+	ErrorBegin Type = (0xdead << 16) | iota
+
+	ErrorInternal
+	ErrorInvalidType
+	ErrorConnectionGone
+	ErrorSend
+	ErrorPermissionDenied
+	ErrorTooManyClients
+	ErrorInvalidData
+	ErrorNameInUse
+	ErrorSessionExpired
+	ErrorExclusiveTaken
+	ErrorNoSuchClient
+	ErrorServerShutdown
+
+	ErrorEnd
+)
+
+func (t Type) String() string {
+	switch t {
+	// types
+	case TypeOpenMic:
+		return "TypeOpenMic"
+	case TypeMicData:
+		return "TypeMicData"
+	case TypeCloseMic:
+		return "TypeCloseMic"
+	case TypeScanCode:
+		return "TypeScanCode"
+	case TypeOpenSound:
+		return "TypeOpenSound"
+	case TypeCloseSound:
+		return "TypeCloseSound"
+	case TypeSoundData:
+		return "TypeSoundData"
+	case TypePing:
+		return "TypePing"
+	case TypeFileTransfer:
+		return "TypeFileTransfer"
+	case TypeAuth:
+		return "TypeAuth"
+	case TypeHandshake:
+		return "TypeHandshake"
+	case TypeRegister:
+		return "TypeRegister"
+	case TypeResume:
+		return "TypeResume"
+	case TypeSubscribe:
+		return "TypeSubscribe"
+	case TypeUnsubscribe:
+		return "TypeUnsubscribe"
+	case TypeMessage:
+		return "TypeMessage"
+	case TypeStatus:
+		return "TypeStatus"
+
+	// errors
+	case ErrorInternal:
+		return "ErrorInternal"
+	case ErrorInvalidType:
+		return "ErrorInvalidType"
+	case ErrorConnectionGone:
+		return "ErrorConnectionGone"
+	case ErrorSend:
+		return "ErrorSend"
+	case ErrorPermissionDenied:
+		return "ErrorPermissionDenied"
+	case ErrorTooManyClients:
+		return "ErrorTooManyClients"
+	case ErrorInvalidData:
+		return "ErrorInvalidData"
+	case ErrorNameInUse:
+		return "ErrorNameInUse"
+	case ErrorSessionExpired:
+		return "ErrorSessionExpired"
+	case ErrorExclusiveTaken:
+		return "ErrorExclusiveTaken"
+	case ErrorNoSuchClient:
+		return "ErrorNoSuchClient"
+	case ErrorServerShutdown:
+		return "ErrorServerShutdown"
+
+	default:
+		return "unknown"
+	}
+}
+
+func (t Type) IsValid() bool {
+	return t.String() != "unknown"
+}
+
+// ParseType returns the Type whose String() is name.
+func ParseType(name string) (Type, bool) {
+	for t := TypeBegin + 1; t < TypeEnd; t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	for t := ErrorBegin + 1; t < ErrorEnd; t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
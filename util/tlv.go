@@ -6,8 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+
+	"github.com/tw4452852/servicemgr/logging"
 )
 
 var InternalErr = errors.New("internal error")
@@ -37,32 +38,31 @@ func WriteTLV(w io.Writer, tlv TLV) error {
 	var b bytes.Buffer
 
 	if int(tlv.L) != binary.Size(tlv.V) {
-		log.Printf("[tlv]: length mismatch expect[%d], but got[%d]\n",
-			binary.Size(tlv.V), int(tlv.L))
+		logging.For(logging.TLV).Debug("length mismatch", "expect", binary.Size(tlv.V), "got", int(tlv.L))
 		return lengthMismatchErr
 	}
 
 	err := binary.Write(&b, binary.BigEndian, tlv.T)
 	if err != nil {
-		log.Printf("[tlv]: write type[%#x] error: %s\n", tlv.T, err)
+		logging.For(logging.TLV).Debug("write type failed", "type", tlv.T, "err", err)
 		return err
 	}
 
 	err = binary.Write(&b, binary.BigEndian, tlv.L)
 	if err != nil {
-		log.Printf("[tlv]: write length[%#x] error: %s\n", tlv.L, err)
+		logging.For(logging.TLV).Debug("write length failed", "length", tlv.L, "err", err)
 		return err
 	}
 
 	err = binary.Write(&b, binary.BigEndian, tlv.V)
 	if err != nil {
-		log.Printf("[tlv]: write value[%v] error: %s\n", tlv.V, err)
+		logging.For(logging.TLV).Debug("write value failed", "tlv", tlv, "err", err)
 		return err
 	}
 
 	err = binary.Write(w, binary.BigEndian, b.Bytes())
 	if err != nil {
-		log.Printf("[tlv]: write tlv %v error: %s\n", tlv, err)
+		logging.For(logging.TLV).Debug("write failed", "tlv", tlv, "err", err)
 		return err
 	}
 
@@ -77,7 +77,7 @@ func ReadTLV(r io.Reader) (tlv TLV, err error) {
 	)
 	defer func() {
 		if e := recover(); e != nil {
-			log.Printf("panic: %v\nt[%#x], l[%#x],  v[%v]\n", e, t, l, v)
+			logging.For(logging.TLV).Error("read panicked", "panic", e, "type", t, "length", l)
 			err = InternalErr
 		}
 	}()
@@ -86,7 +86,7 @@ func ReadTLV(r io.Reader) (tlv TLV, err error) {
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[tlv]: read type error: %s\n", err)
+			logging.For(logging.TLV).Debug("read type failed", "err", err)
 		}
 		return
 	}
@@ -95,7 +95,7 @@ func ReadTLV(r io.Reader) (tlv TLV, err error) {
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[tlv]: read length error: %s\n", err)
+			logging.For(logging.TLV).Debug("read length failed", "err", err)
 		}
 		return
 	}
@@ -105,7 +105,7 @@ func ReadTLV(r io.Reader) (tlv TLV, err error) {
 	if err != nil {
 		ne, ok := err.(net.Error)
 		if !ok || !ne.Temporary() {
-			log.Printf("[tlv]: read value error: %s\n", err)
+			logging.For(logging.TLV).Debug("read value failed", "err", err)
 		}
 		return
 	}